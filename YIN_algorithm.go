@@ -16,17 +16,62 @@
 //package main
 package qbsh
 
-func findMainFrequency(buff []float32) (frequency float64, probability float64) {
-	//arr :=  [YIN_SAMPLING_RATE / 2]float64{}
-	//yin := Yin{0,0, arr, 0.0, 0.0}
-	yin := Yin{}
-	//bufferSize := 44100
-	bufferSize := len(buff) // 11025
-	threashold := 0.05
-	yin.YinInit(bufferSize, threashold)
-	frequency = yin.YinGetPitch(buff)
-	probability = yin.YinGetProbability()
-	return frequency, probability
+import "github.com/mjibson/go-dsp/fft"
+
+// YinConfig configures a Yin tracker
+type YinConfig struct {
+	SampleRate int
+	// samples in a frame. The lowest pitch found is
+	// SampleRate / (BufferSize / 2)
+	BufferSize int
+	// samples between the start of frames
+	HopSize int
+	// allowed aperiodicity, e.g. 0.05 gives pitch with ~95% probability
+	Threshold float64
+}
+
+// DefaultYinConfig uses frames of about 50ms, 16 frames per second, and
+// can find pitch down to about 40Hz
+func DefaultYinConfig(sampleRate int) YinConfig {
+	bufferSize := 256
+	for bufferSize < sampleRate/20 {
+		bufferSize *= 2
+	}
+	return YinConfig{
+		SampleRate: sampleRate,
+		BufferSize: bufferSize,
+		HopSize:    sampleRate / 16,
+		Threshold:  0.05,
+	}
+}
+
+// YinFrame is the pitch of a frame, Frequency is -1 if not found
+type YinFrame struct {
+	Frequency   float64
+	Probability float64
+}
+
+// YinCreate makes a Yin tracker. It can be reused for any number of frames
+// and recordings, but not by several goroutines at once.
+func YinCreate(cfg YinConfig) *Yin {
+	yin := &Yin{}
+	yin.YinInit(cfg.BufferSize, cfg.Threshold)
+	yin.sampleRate = cfg.SampleRate
+	yin.hopSize = cfg.HopSize
+	if yin.hopSize <= 0 {
+		yin.hopSize = cfg.BufferSize
+	}
+	return yin
+}
+
+// YinTrack finds the pitch of every frame of samples
+func (Y *Yin) YinTrack(samples []float64) []YinFrame {
+	var out []YinFrame
+	for start := 0; start+Y.bufferSize <= len(samples); start += Y.hopSize {
+		frequency := Y.yinGetPitch(samples[start : start+Y.bufferSize])
+		out = append(out, YinFrame{frequency, Y.probability})
+	}
+	return out
 }
 
 //################################################################
@@ -41,6 +86,12 @@ type Yin struct {
 	yinBuffer      []float64 // Buffer that stores the results of the intermediate processing steps of the algorithm
 	probability    float64   // Probability that the pitch found is correct as a decimal (i.e 0.85 is 85%)
 	threshold      float64   // Allowed uncertainty in the result as a decimal (i.e 0.15 is 15%)
+	sampleRate     int       // Sample rate of the buffer
+	hopSize        int       // Samples between frames in YinTrack
+	samples        []float64 // Buffer converted to float64
+	diffBuffer     []float64 // Copy of yinBuffer after step 1
+	window         []complex128
+	frame          []complex128
 }
 
 // threshold  Allowed uncertainty (e.g 0.05 will return a pitch with ~95% probability)
@@ -51,16 +102,34 @@ func (Y *Yin) YinInit(bufferSize int, threshold float64) {
 	Y.probability = 0.0
 	Y.threshold = threshold
 
-	// Allocate the autocorellation buffer and initialise it to zero.
-	Y.yinBuffer = make([]float64, BUFF_SIZE/2)
+	Y.sampleRate = YIN_SAMPLING_RATE
+
+	// Allocate the autocorellation buffer, yinDifference fills it for each frame.
+	Y.yinBuffer = make([]float64, Y.halfBufferSize)
+	Y.samples = make([]float64, bufferSize)
+	Y.diffBuffer = make([]float64, Y.halfBufferSize)
+	fftSize := 1
+	for fftSize < bufferSize+Y.halfBufferSize {
+		fftSize *= 2
+	}
+	Y.window = make([]complex128, fftSize)
+	Y.frame = make([]complex128, fftSize)
 }
 
 // Runs the Yin pitch detection algortihm
 //        buffer       - Buffer of samples to analyse
 // return pitchInHertz - Fundamental frequency of the signal in Hz. Returns -1 if pitch can't be found
 func (Y *Yin) YinGetPitch(buffer []float32) (pitchInHertz float64) {
+	for i := range Y.samples {
+		Y.samples[i] = float64(buffer[i])
+	}
+	return Y.yinGetPitch(Y.samples)
+}
+
+func (Y *Yin) yinGetPitch(buffer []float64) (pitchInHertz float64) {
 	//tauEstimate int      := -1
 	pitchInHertz = -1
+	Y.probability = 0
 
 	// Step 1: CalcuYinGetPitchlates the squared difference of the signal with a shifted version of itself.
 	Y.yinDifference(buffer)
@@ -73,7 +142,7 @@ func (Y *Yin) YinGetPitch(buffer []float32) (pitchInHertz float64) {
 
 	// Step 5: Interpolate the shift value (tau) to improve the pitch estimate.
 	if tauEstimate != -1 {
-		pitchInHertz = float64(YIN_SAMPLING_RATE) / Y.yinParabolicInterpolation(tauEstimate)
+		pitchInHertz = float64(Y.sampleRate) / Y.yinParabolicInterpolation(tauEstimate)
 	}
 
 	return pitchInHertz
@@ -90,17 +159,40 @@ func (Y *Yin) YinGetProbability() (probability float64) {
 //
 // This is the Yin algorithms tweak on autocorellation. Read http://audition.ens.fr/adc/pdf/2002_JASA_YIN.pdf
 // for more details on what is in here and why it's done this way.
-func (Y *Yin) yinDifference(buffer []float32) {
-	// Calculate the difference for difference shift values (tau) for the half of the samples.
-	for tau := 0; tau < Y.halfBufferSize; tau++ {
-
-		// Take the difference of the signal with a shifted version of itself, then square it.
-		// (This is the Yin algorithm's tweak on autocorellation)
-		for i := 0; i < Y.halfBufferSize; i++ {
-			delta := float64(buffer[i]) - float64(buffer[i+tau])
-			Y.yinBuffer[tau] += delta * delta
-		}
+//
+// The sum over the first half of buffer of (x[i] - x[i+tau])^2 is expanded into
+// x[i]^2 + x[i+tau]^2 - 2 x[i] x[i+tau], and the last term is a cross
+// correlation computed by FFT, like Pyin.pyinDifference.
+func (Y *Yin) yinDifference(buffer []float64) {
+	half := Y.halfBufferSize
+	for i := range Y.window {
+		Y.window[i] = 0
+		Y.frame[i] = 0
+	}
+	for i := 0; i < half; i++ {
+		Y.window[i] = complex(buffer[i], 0)
+	}
+	for i := 0; i < Y.bufferSize; i++ {
+		Y.frame[i] = complex(buffer[i], 0)
+	}
+	a := fft.FFT(Y.window)
+	b := fft.FFT(Y.frame)
+	for i := range a {
+		a[i] = complex(real(a[i]), -imag(a[i])) * b[i]
+	}
+	corr := fft.IFFT(a)
+
+	// energy of the window starting at tau
+	energy := 0.0
+	for i := 0; i < half; i++ {
+		energy += buffer[i] * buffer[i]
+	}
+	first := energy
+	for tau := 0; tau < half; tau++ {
+		Y.yinBuffer[tau] = first + energy - 2*real(corr[tau])
+		energy += buffer[tau+half]*buffer[tau+half] - buffer[tau]*buffer[tau]
 	}
+	copy(Y.diffBuffer, Y.yinBuffer)
 }
 
 // Step 2: Calculate the cumulative mean on the normalised difference calculated in step 1
@@ -198,9 +290,11 @@ func (Y *Yin) yinParabolicInterpolation(tauEstimate int) float64 {
 		}
 	} else {
 		var s0, s1, s2 float64
-		s0 = Y.yinBuffer[x0]
-		s1 = Y.yinBuffer[tauEstimate]
-		s2 = Y.yinBuffer[x2]
+		// the difference before normalization is closer to a parabola
+		// around its dip, which matters at short periods
+		s0 = Y.diffBuffer[x0]
+		s1 = Y.diffBuffer[tauEstimate]
+		s2 = Y.diffBuffer[x2]
 		// fixed AUBIO implementation, thanks to Karl Helgason:
 		// (2.0f * s1 - s2 - s0) was incorrectly multiplied with -1
 		betterTau = float64(tauEstimate) + (s2-s0)/(2*(2*s1-s2-s0))
@@ -0,0 +1,125 @@
+package qbsh
+
+import "math"
+
+// AlignmentStep is a query frame matched to a song frame on a DTW path
+type AlignmentStep struct {
+	Query int       `json:"query"`
+	Song  int       `json:"song"`
+	Cost  PitchType `json:"cost"`
+}
+
+// dtwMove is a way to reach cell (i, j) from cell (i+di, j+dj), passing
+// cell (i+mi, j+mj) on the way if hasMid is true
+type dtwMove struct {
+	di, dj int
+	hasMid bool
+	mi, mj int
+}
+
+// moves in the order DTWConstraint.cell tries them
+var dtwMoves = [][3]dtwMove{
+	{{di: -1, dj: 0}, {di: -1, dj: -1}, {di: 0, dj: -1}},
+	{{di: -1, dj: -1}, {-2, -1, true, -1, 0}, {-1, -2, true, 0, -1}},
+}
+
+// DTW_path is DTW_find_where_constrained that also returns the warping
+// path of the best match, from the first query frame to the last. Song
+// indices are relative to song.
+func DTW_path(song []PitchType, query []PitchType, shift PitchType, c DTWConstraint) (PitchType, []AlignmentStep) {
+	var d DTW_tmp
+	ans, from, to := d.dtwConstrained(song, query, shift, c)
+	if ans >= dtwInf {
+		return ans, nil
+	}
+	path := alignMatch(song[from:to+1], query, shift, c)
+	for k := range path {
+		path[k].Song += from
+	}
+	return ans, path
+}
+
+// alignMatch returns the warping path of the best match of query that
+// starts at the first frame of song and ends at the last. With the start
+// fixed, the band is |i - j| <= Band, so each cell has one state and the
+// table takes len(song)*len(query) floats.
+func alignMatch(song []PitchType, query []PitchType, shift PitchType, c DTWConstraint) []AlignmentStep {
+	n1 := len(song)
+	n2 := len(query)
+	if n1 == 0 || n2 == 0 {
+		return nil
+	}
+	c = c.forQuery(n2)
+	table := make([]PitchType, n1*n2)
+	inf := PitchType(math.Inf(1))
+	// best score of a path from the start to cell (i, j)
+	at := func(i, j int) PitchType {
+		if i == -1 && j == -1 {
+			return 0
+		}
+		if i < 0 || j < 0 || c.Band > 0 && (i-j > c.Band || j-i > c.Band) {
+			return inf
+		}
+		return table[i*n2+j]
+	}
+	cost := func(i, j int) PitchType {
+		return dtwCost(song[i], query[j]-shift)
+	}
+	moves := dtwMoves[0]
+	if c.LimitSlope {
+		moves = dtwMoves[1]
+	}
+	// score of reaching (i, j) by move m, without the cost of (i, j)
+	via := func(i, j int, m dtwMove) PitchType {
+		if m.hasMid && (i+m.mi < 0 || j+m.mj < 0) {
+			return inf
+		}
+		sco := at(i+m.di, j+m.dj)
+		if m.hasMid {
+			sco += cost(i+m.mi, j+m.mj)
+		}
+		return sco
+	}
+	for i := 0; i < n1; i++ {
+		for j := 0; j < n2; j++ {
+			best := inf
+			for _, m := range moves {
+				if sco := via(i, j, m); sco < best {
+					best = sco
+				}
+			}
+			table[i*n2+j] = best + cost(i, j)
+		}
+	}
+	if at(n1-1, n2-1) == inf {
+		return nil
+	}
+
+	// walk back, taking the first move that gives the score of each cell
+	var path []AlignmentStep
+	i, j := n1-1, n2-1
+	for j >= 0 {
+		here := at(i, j)
+		path = append(path, AlignmentStep{j, i, cost(i, j)})
+		found := false
+		for _, m := range moves {
+			if via(i, j, m)+cost(i, j) != here {
+				continue
+			}
+			if m.hasMid {
+				path = append(path, AlignmentStep{j + m.mj, i + m.mi, cost(i+m.mi, j+m.mj)})
+			}
+			i, j = i+m.di, j+m.dj
+			found = true
+			break
+		}
+		if !found {
+			// cannot happen unless the table is inconsistent
+			return nil
+		}
+	}
+	for a, b := 0, len(path)-1; a < b; a, b = a+1, b-1 {
+		path[a], path[b] = path[b], path[a]
+	}
+	return path
+}
@@ -1,7 +1,9 @@
 package qbsh
 
 import (
+	"io"
 	"math"
+	"os"
 
 	"github.com/unixpickle/wav"
 )
@@ -19,105 +21,184 @@ func ConvertHzToPitch(frequency float64) PitchType {
 }
 
 func GetWavPitch(path string) ([]PitchType, error) {
-	s, err := wav.ReadSoundFile(path)
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
+	return GetReaderPitch(f)
+}
+
+// GetReaderPitch is GetWavPitch for a WAV file read from r
+func GetReaderPitch(r io.Reader) ([]PitchType, error) {
+	s, err := wav.ReadSound(r)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := PrepareSamples(soundSamples(s), s.Channels(), s.SampleRate())
+	if err != nil {
+		return nil, err
+	}
+	return yinPitch(samples), nil
+}
 
-	bufSize := 2048
-	stepSize := s.SampleRate() / 16
-	buf := make([]float32, bufSize)
+// GetSamplesPitch is GetWavPitch for mono samples from -1 to 1
+func GetSamplesPitch(samples []float64, sampleRate int) ([]PitchType, error) {
+	prepared, err := PrepareSamples(samples, 1, sampleRate)
+	if err != nil {
+		return nil, err
+	}
+	return yinPitch(prepared), nil
+}
+
+// yinPitch tracks prepared samples with Yin
+func yinPitch(samples []float64) []PitchType {
+	yin := YinCreate(DefaultYinConfig(AnalysisSampleRate))
 	out := make([]PitchType, 0)
-	j := 0
-	for _, sample := range s.Samples() {
-		if j >= 0 {
-			buf[j] = float32(sample)
-		}
-		j++
-		if j == bufSize {
-			frequency, probability := findMainFrequency(buf)
-			frequency *= float64(s.SampleRate()) / 44100
-			pitch := PitchType(-1)
-			if probability > 0.5 {
-				pitch = ConvertHzToPitch(frequency)
-			}
-			out = append(out, pitch)
-			// move buffer
-			for i := 0; i < bufSize-stepSize; i++ {
-				buf[i] = buf[i+stepSize]
-			}
-			j -= stepSize
+	for _, frame := range yin.YinTrack(samples) {
+		pitch := PitchType(-1)
+		if frame.Probability > 0.5 {
+			pitch = ConvertHzToPitch(frame.Frequency)
 		}
+		out = append(out, pitch)
 	}
-	return out, nil
+	return out
 }
 
 func GetWavPitch2(path string) ([]PitchType, error) {
-	s, err := wav.ReadSoundFile(path)
+	pitch, _, err := GetWavPitchVoicing(path)
+	return pitch, err
+}
+
+// GetReaderPitch2 is GetWavPitch2 for a WAV file read from r
+func GetReaderPitch2(r io.Reader) ([]PitchType, error) {
+	pitch, _, err := GetReaderPitchVoicing(r)
+	return pitch, err
+}
+
+// GetSamplesPitch2 is GetWavPitch2 for mono samples from -1 to 1
+func GetSamplesPitch2(samples []float64, sampleRate int) ([]PitchType, error) {
+	pitch, _, err := GetSamplesPitchVoicing(samples, sampleRate)
+	return pitch, err
+}
+
+// GetWavPitchVoicing is GetWavPitch2, and also returns the confidence that
+// each frame has voice, for FixPitchVoicing
+func GetWavPitchVoicing(path string) ([]PitchType, []float64, error) {
+	return GetWavPitchWithOptions(path, DefaultPitchOptions())
+}
+
+// GetReaderPitchVoicing is GetWavPitchVoicing for a WAV file read from r
+func GetReaderPitchVoicing(r io.Reader) ([]PitchType, []float64, error) {
+	return GetReaderPitchWithOptions(r, DefaultPitchOptions())
+}
+
+// GetSamplesPitchVoicing is GetWavPitchVoicing for mono samples from -1 to 1
+func GetSamplesPitchVoicing(samples []float64, sampleRate int) ([]PitchType, []float64, error) {
+	return GetSamplesPitchWithOptions(samples, sampleRate, DefaultPitchOptions())
+}
+
+// GetWavPitchWithOptions is GetWavPitchVoicing with tuned pYIN
+func GetWavPitchWithOptions(path string, opts PitchOptions) ([]PitchType, []float64, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer f.Close()
+	return GetReaderPitchWithOptions(f, opts)
+}
 
-	bufSize := 512
-	for bufSize < s.SampleRate()/30 {
-		bufSize *= 2
+// GetReaderPitchWithOptions is GetWavPitchWithOptions for a WAV file read
+// from r
+func GetReaderPitchWithOptions(r io.Reader, opts PitchOptions) ([]PitchType, []float64, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, nil, err
 	}
-	stepSize := s.SampleRate() / 100
-	buf := make([]float64, bufSize)
-	pyin := PyinCreate(bufSize, s.SampleRate())
-	pyin.HopLength = stepSize
-	pyin.PyinInit()
-	out := make([]PitchType, 0)
-	j := 0
-	prob := pyin.PyinHMMInit()
-	backpath := make([][]int, 0)
-	frames := make([][]PyinCandidate, 0)
-	for _, sample := range s.Samples() {
-		if j >= 0 {
-			buf[j] = float64(sample)
-		}
-		j++
-		if j == bufSize {
-			cand := pyin.PyinFindFrequency(buf)
-			var back []int
-			prob, back = pyin.PyinHMMForward(cand, prob)
-			backpath = append(backpath, back)
-			frames = append(frames, cand)
-			frequency := -1.0
-			if len(cand) > 0 {
-				frequency = cand[0].Frequency
-			}
-			probability := 0.0
-			for i := range cand {
-				probability += cand[i].Probability
-			}
-			pitch := PitchType(-1)
-			if probability > 0.5 {
-				pitch = ConvertHzToPitch(frequency)
-			}
-			out = append(out, pitch)
-			// move buffer
-			for i := 0; i < bufSize-stepSize; i++ {
-				buf[i] = buf[i+stepSize]
-			}
-			j -= stepSize
-		}
+	s, err := wav.ReadSound(r)
+	if err != nil {
+		return nil, nil, err
 	}
-	better := pyin.PyinHMMViterbi(frames, backpath, prob)
-	for i := range better {
-		out[i] = ConvertHzToPitch(better[i].Frequency)
-		if better[i].Probability < 0.3 {
-			out[i] = -1
-		}
+	samples, err := PrepareSamples(soundSamples(s), s.Channels(), s.SampleRate())
+	if err != nil {
+		return nil, nil, err
+	}
+	return pyinPitch(samples, opts)
+}
+
+// GetSamplesPitchWithOptions is GetWavPitchWithOptions for mono samples
+// from -1 to 1
+func GetSamplesPitchWithOptions(samples []float64, sampleRate int, opts PitchOptions) ([]PitchType, []float64, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, nil, err
+	}
+	prepared, err := PrepareSamples(samples, 1, sampleRate)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pyinPitch(prepared, opts)
+}
+
+// pyinPitch tracks prepared samples with pYIN
+func pyinPitch(samples []float64, opts PitchOptions) ([]PitchType, []float64, error) {
+	tracker, err := NewPitchTrackerWithOptions(AnalysisSampleRate, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	tracker.Lag = 0
+	tracker.write(samples)
+	out := tracker.Flush()
+	voicing := tracker.Voicing()
+	if out == nil {
+		out = []PitchType{}
+		voicing = []float64{}
 	}
-	resample := make([]PitchType, len(out)/5)
-	for i := 0; (i+1)*5 <= len(out); i++ {
-		resample[i] = Median(out[i*5 : (i+1)*5])
+	return out, voicing, nil
+}
+
+func soundSamples(s wav.Sound) []float64 {
+	samples := make([]float64, len(s.Samples()))
+	for i, sample := range s.Samples() {
+		samples[i] = float64(sample)
 	}
-	return resample, nil
+	return samples
 }
 
 func FixPitch(pitchVec []PitchType) []PitchType {
+	return FixPitchVoicing(pitchVec, nil)
+}
+
+// frames without pitch and with voicing below this are rests, the others
+// are dropouts of the pitch tracker
+const restVoicing = 0.5
+
+// rests longer than this many frames are shortened
+const maxRestFrames = 10
+
+// ToPitchFrameRate picks frames of pitch tracked at rate frames per
+// second, so that queries have PitchFrameRate frames per second like
+// songs. voicing may be nil.
+func ToPitchFrameRate(pitch []PitchType, voicing []float64, rate float64) ([]PitchType, []float64) {
+	n := int(float64(len(pitch)) * PitchFrameRate / rate)
+	out := make([]PitchType, n)
+	var outVoicing []float64
+	if voicing != nil {
+		outVoicing = make([]float64, n)
+	}
+	for i := range out {
+		k := int(float64(i) * rate / PitchFrameRate)
+		out[i] = pitch[k]
+		if voicing != nil {
+			outVoicing[i] = voicing[k]
+		}
+	}
+	return out, outVoicing
+}
+
+// FixPitchVoicing is FixPitch for pitch with voicing confidence from
+// GetWavPitchVoicing. Dropouts are filled with the previous pitch like
+// FixPitch does, but long rests are shortened, so pauses between phrases
+// do not stretch the query. nil voicing treats every frame as a dropout.
+func FixPitchVoicing(pitchVec []PitchType, voicing []float64) []PitchType {
 	// crop trailing silence
 	start := 0
 	for ; start < len(pitchVec); start++ {
@@ -134,27 +215,27 @@ func FixPitch(pitchVec []PitchType) []PitchType {
 	if start > end {
 		return nil
 	}
-	pitchVec = pitchVec[start : end+1]
-	ptc := make([]PitchType, len(pitchVec))
-	copy(ptc, pitchVec)
+	ptc := make([]PitchType, 0, end+1-start)
 
 	// fill missing pitch
 	prevPitch := PitchType(0)
-	for i := range ptc {
-		if ptc[i] == -1 {
-			ptc[i] = prevPitch
-		} else {
-			prevPitch = ptc[i]
+	rest := 0
+	for i := start; i <= end; i++ {
+		if pitchVec[i] != -1 {
+			prevPitch = pitchVec[i]
+			rest = 0
+		} else if voicing != nil && voicing[i] < restVoicing {
+			rest++
+			if rest > maxRestFrames {
+				continue
+			}
 		}
+		ptc = append(ptc, prevPitch)
 	}
 
-	// remove extreme value
-	/*mid := Median(ptc)
-	for i := range ptc {
-		if ptc[i]-mid >= 12 || mid-ptc[i] >= 12 {
-			ptc[i] = mid + PitchType(math.Mod(float64(ptc[i]-mid), 12.0))
-		}
-	}*/
+	// fold octave errors
+	octave := DefaultOctaveOptions()
+	ptc = FixOctave(ptc, &octave)
 
 	// median filter
 	ptc2 := make([]PitchType, len(ptc))
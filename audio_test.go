@@ -0,0 +1,532 @@
+package qbsh
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/unixpickle/wav"
+)
+
+// hum makes a sine melody with a short rest, half a second per note
+func hum(notes []float64, sampleRate int) []float32 {
+	var out []float32
+	phase := 0.0
+	for _, note := range notes {
+		for i := 0; i < sampleRate/2; i++ {
+			if note < 0 {
+				out = append(out, 0)
+				continue
+			}
+			freq := 440 * math.Pow(2, (note-69)/12)
+			phase += 2 * math.Pi * freq / float64(sampleRate)
+			out = append(out, float32(0.5*math.Sin(phase)+0.2*math.Sin(2*phase)))
+		}
+	}
+	return out
+}
+
+func TestPitchTracker(t *testing.T) {
+	notes := []float64{60, 62, 64, -1, 67}
+	samples := hum(notes, 16000)
+
+	whole, err := NewPitchTracker(16000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whole.Lag = 0
+	if out := whole.Write(samples); out != nil {
+		t.Errorf("tracker without lag returns %d frames before Flush", len(out))
+	}
+	want := whole.Flush()
+
+	tracker, _ := NewPitchTracker(16000)
+	var got []PitchType
+	early := 0
+	for pos, size := 0, 1; pos < len(samples); pos, size = pos+size, size*3%1999+1 {
+		end := IntMin(pos+size, len(samples))
+		got = append(got, tracker.Write(samples[pos:end])...)
+		early = len(got)
+	}
+	got = append(got, tracker.Flush()...)
+	if early == 0 {
+		t.Error("no frames before Flush")
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames, want %d", len(got), len(want))
+	}
+	same := 0
+	for i := range got {
+		if got[i] == want[i] {
+			same++
+		}
+	}
+	if same < len(got)*9/10 {
+		t.Errorf("only %d of %d frames agree with offline tracking", same, len(got))
+	}
+	// 20 frames per second, the middle of each note
+	for k, note := range notes {
+		p := got[k*10+5]
+		if note < 0 && p != -1 || note >= 0 && math.Abs(float64(p)-note) > 0.3 {
+			t.Errorf("note %d: got pitch %v, want %v", k, p, note)
+		}
+	}
+
+	// the tracker is reusable after Flush
+	again := tracker.Write(samples)
+	again = append(again, tracker.Flush()...)
+	if len(again) != len(want) {
+		t.Errorf("second recording gives %d frames, want %d", len(again), len(want))
+	}
+}
+
+func TestReaderPitch(t *testing.T) {
+	samples := hum([]float64{60, 64, 67}, 8000)
+	sound := wav.NewPCM16Sound(1, 8000)
+	wavSamples := make([]wav.Sample, len(samples))
+	for i, s := range samples {
+		wavSamples[i] = wav.Sample(s)
+	}
+	sound.SetSamples(wavSamples)
+	var buf bytes.Buffer
+	if err := sound.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	// compare with the samples as stored in 16 bits
+	decoded, err := wav.ReadSound(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := soundSamples(decoded)
+	got, err := GetReaderPitch2(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := GetSamplesPitch2(raw, 8000); !reflect.DeepEqual(got, want) || len(got) == 0 {
+		t.Errorf("reader gives %v, samples give %v", got, want)
+	}
+	got, err = GetReaderPitch(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := GetSamplesPitch(raw, 8000); !reflect.DeepEqual(got, want) {
+		t.Errorf("reader gives %v, samples give %v", got, want)
+	}
+	if _, err := GetReaderPitch2(bytes.NewReader(encoded[:20])); err == nil {
+		t.Error("broken WAV gives no error")
+	}
+
+	// a sample rate of 0 in the header must not hang the resampler
+	header := wav.NewHeader()
+	header.Format.NumChannels = 1
+	header.Format.BitsPerSample = 16
+	header.Data.Size = 2000
+	buf.Reset()
+	header.Write(&buf)
+	buf.Write(make([]byte, 2000))
+	if _, err := GetReaderPitch2(bytes.NewReader(buf.Bytes())); err != ErrBadSampleRate {
+		t.Errorf("sample rate 0 gives error %v", err)
+	}
+	for _, rate := range []int{-1, 1, MinSampleRate - 1, MaxSampleRate + 1} {
+		if _, err := GetSamplesPitch(raw, rate); err != ErrBadSampleRate {
+			t.Errorf("sample rate %d gives error %v", rate, err)
+		}
+		if _, err := NewPitchTracker(rate); err != ErrBadSampleRate {
+			t.Errorf("tracker at sample rate %d gives error %v", rate, err)
+		}
+	}
+	if _, err := PrepareSamples(raw, 0, 8000); err != ErrBadChannels {
+		t.Errorf("0 channels gives error %v", err)
+	}
+}
+
+func TestYin(t *testing.T) {
+	for _, sampleRate := range []int{8000, 16000, 44100, 48000} {
+		yin := YinCreate(DefaultYinConfig(sampleRate))
+		for _, freq := range []float64{82.41, 110, 196, 261.63, 440, 659.26, 987.77} {
+			samples := make([]float64, sampleRate*3/10)
+			for i := range samples {
+				phase := 2 * math.Pi * freq * float64(i) / float64(sampleRate)
+				samples[i] = 0.5*math.Sin(phase) + 0.2*math.Sin(2*phase)
+			}
+			frames := yin.YinTrack(samples)
+			if len(frames) == 0 {
+				t.Fatalf("%d Hz: no frames", sampleRate)
+			}
+			want := 12 * math.Log2(freq/440)
+			for _, frame := range frames {
+				got := 12 * math.Log2(frame.Frequency/440)
+				if frame.Probability < 0.9 || math.Abs(got-want) > 0.1 {
+					t.Errorf("%d Hz sample rate: %v Hz found as %v Hz with probability %v",
+						sampleRate, freq, frame.Frequency, frame.Probability)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestYinDifference(t *testing.T) {
+	yin := YinCreate(DefaultYinConfig(8000))
+	samples := make([]float64, yin.bufferSize)
+	for i := range samples {
+		samples[i] = math.Sin(float64(i)*0.3) + 0.3*math.Cos(float64(i)*1.7)
+	}
+	yin.yinDifference(samples)
+	for tau := 0; tau < yin.halfBufferSize; tau++ {
+		want := 0.0
+		for i := 0; i < yin.halfBufferSize; i++ {
+			delta := samples[i] - samples[i+tau]
+			want += delta * delta
+		}
+		if math.Abs(yin.yinBuffer[tau]-want) > 1e-6 {
+			t.Fatalf("difference at %d is %v, want %v", tau, yin.yinBuffer[tau], want)
+		}
+	}
+}
+
+// tone measures the amplitude of freq in samples
+func tone(samples []float64, freq float64, sampleRate int) float64 {
+	re, im := 0.0, 0.0
+	for i, s := range samples {
+		phase := 2 * math.Pi * freq * float64(i) / float64(sampleRate)
+		re += s * math.Cos(phase)
+		im += s * math.Sin(phase)
+	}
+	return 2 * math.Hypot(re, im) / float64(len(samples))
+}
+
+func TestPrepareSamples(t *testing.T) {
+	// stereo at 48kHz, the right channel has a 12kHz tone, which would
+	// alias to 4kHz without filtering
+	rate := 48000
+	stereo := make([]float64, rate*2)
+	for i := 0; i < rate; i++ {
+		x := 0.3 * math.Sin(2*math.Pi*440*float64(i)/float64(rate))
+		stereo[i*2] = x
+		stereo[i*2+1] = x + 0.3*math.Sin(2*math.Pi*12000*float64(i)/float64(rate))
+	}
+	out, err := PrepareSamples(stereo, 2, rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != AnalysisSampleRate {
+		t.Fatalf("got %d samples, want %d", len(out), AnalysisSampleRate)
+	}
+	mid := out[1000 : len(out)-1000]
+	sum := 0.0
+	for _, s := range mid {
+		sum += s * s
+	}
+	if rms := math.Sqrt(sum / float64(len(mid))); math.Abs(rms-targetRMS) > 0.01 {
+		t.Errorf("RMS level is %v, want %v", rms, targetRMS)
+	}
+	signal := tone(mid, 440, AnalysisSampleRate)
+	alias := tone(mid, 4000, AnalysisSampleRate)
+	if signal < 0.13 || alias > signal*1e-3 {
+		t.Errorf("440Hz amplitude %v, alias amplitude %v", signal, alias)
+	}
+
+	// upsampling keeps the tone
+	low := make([]float64, 8000)
+	for i := range low {
+		low[i] = 0.5 * math.Sin(2*math.Pi*1000*float64(i)/8000)
+	}
+	r, _ := NewResampler(8000, AnalysisSampleRate)
+	up := r.Resample(low)
+	if len(up) != 16000 {
+		t.Fatalf("got %d samples, want 16000", len(up))
+	}
+	for i := 500; i < len(up)-500; i++ {
+		want := 0.5 * math.Sin(2*math.Pi*1000*float64(i)/16000)
+		if math.Abs(up[i]-want) > 0.01 {
+			t.Fatalf("sample %d is %v, want %v", i, up[i], want)
+		}
+	}
+}
+
+func TestResamplerChunks(t *testing.T) {
+	samples := make([]float64, 20000)
+	for i := range samples {
+		samples[i] = math.Sin(float64(i)*0.01) + 0.2*math.Sin(float64(i)*2.3)
+	}
+	for _, rate := range []int{8000, 22050, 44100, 44101} {
+		r, err := NewResampler(rate, AnalysisSampleRate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := r.Resample(samples)
+		var got []float64
+		for pos, size := 0, 1; pos < len(samples); pos, size = pos+size, size*7%997+1 {
+			end := IntMin(pos+size, len(samples))
+			got = append(got, r.Process(samples[pos:end])...)
+		}
+		got = append(got, r.Flush()...)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d Hz: chunks give %d samples, whole gives %d", rate, len(got), len(want))
+		}
+	}
+}
+
+func TestVAD(t *testing.T) {
+	// noise everywhere, and a rest with only noise
+	notes := []float64{60, 62, -1, -1, 64}
+	clean := hum(notes, 16000)
+	rng := rand.New(rand.NewSource(1))
+	samples := make([]float64, len(clean))
+	for i, s := range clean {
+		samples[i] = float64(s) + 0.03*rng.NormFloat64()
+	}
+	opts := DefaultPitchOptions()
+	vad := DefaultVADOptions()
+	opts.VAD = &vad
+	pitch, voicing, err := GetSamplesPitchWithOptions(samples, 16000, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(voicing) != len(pitch) {
+		t.Fatalf("%d voicing frames for %d pitch frames", len(voicing), len(pitch))
+	}
+	for k, note := range notes {
+		for i := k*10 + 2; i < k*10+8; i++ {
+			if note >= 0 && (voicing[i] < 0.9 || math.Abs(float64(pitch[i])-note) > 0.3) {
+				t.Errorf("frame %d: pitch %v voicing %v, want note %v", i, pitch[i], voicing[i], note)
+			}
+			if note < 0 && (voicing[i] > 0.1 || pitch[i] != -1) {
+				t.Errorf("frame %d: pitch %v voicing %v in rest", i, pitch[i], voicing[i])
+			}
+		}
+	}
+
+	// thresholds are tunable, and nil turns detection off
+	tracker, _ := NewPitchTracker(16000)
+	tracker.Lag = 0
+	tracker.VAD = nil
+	tracker.write(samples)
+	tracker.Flush()
+	for i, v := range tracker.Voicing() {
+		if v != 1 {
+			t.Fatalf("frame %d has voicing %v without detection", i, v)
+		}
+	}
+	vad.EnergyFloor = 0
+	tracker.VAD = &vad
+	tracker.write(samples)
+	for i, p := range tracker.Flush() {
+		if p != -1 {
+			t.Fatalf("frame %d has pitch %v under the energy floor", i, p)
+		}
+	}
+}
+
+func TestVADLongVoice(t *testing.T) {
+	// 12 seconds of legato humming without rests
+	var notes []float64
+	for i := 0; i < 24; i++ {
+		notes = append(notes, float64(60+i%5))
+	}
+	clean := hum(notes, 16000)
+	rng := rand.New(rand.NewSource(2))
+	samples := make([]float64, len(clean))
+	for i, s := range clean {
+		samples[i] = float64(s) + 0.01*rng.NormFloat64()
+	}
+	opts := DefaultPitchOptions()
+	vad := DefaultVADOptions()
+	opts.VAD = &vad
+	pitch, voicing, err := GetSamplesPitchWithOptions(samples, 16000, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pitch) < len(notes)*10-5 {
+		t.Fatalf("got %d frames, want %d", len(pitch), len(notes)*10)
+	}
+	unvoiced := 0
+	for i := range pitch {
+		if voicing[i] < 0.5 {
+			t.Fatalf("frame %d: voicing %v in continuous voice", i, voicing[i])
+		}
+		if pitch[i] == -1 {
+			unvoiced++
+		}
+	}
+	if unvoiced > len(pitch)/20 {
+		t.Errorf("%d of %d frames have no pitch", unvoiced, len(pitch))
+	}
+	if got := FixPitchVoicing(pitch, voicing); len(got) < len(pitch)-2 {
+		t.Errorf("FixPitchVoicing keeps %d of %d frames", len(got), len(pitch))
+	}
+
+	// the detector is off by default
+	if tracker, _ := NewPitchTracker(16000); DefaultPitchOptions().VAD != nil || tracker.VAD != nil {
+		t.Error("voice activity detection is on by default")
+	}
+}
+
+func TestFixPitchVoicing(t *testing.T) {
+	pitch := []PitchType{-1, 60, -1, -1, 62}
+	voicing := []float64{0, 1, 0.9, 0.8, 1}
+	for i := 0; i < 15; i++ {
+		pitch = append(pitch, -1)
+		voicing = append(voicing, 0)
+	}
+	pitch = append(pitch, 64, 64, -1)
+	voicing = append(voicing, 1, 1, 0)
+
+	// dropouts are filled, the rest is shortened to maxRestFrames
+	got := FixPitchVoicing(pitch, voicing)
+	want := []PitchType{60, 60, 60, 62}
+	for i := 0; i < maxRestFrames; i++ {
+		want = append(want, 62)
+	}
+	want = append(want, 64, 64)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := FixPitchVoicing(pitch, nil); len(got) != 21 {
+		t.Errorf("without voicing got %d frames, want 21", len(got))
+	}
+	if got := FixPitch(pitch); len(got) != 21 {
+		t.Errorf("FixPitch got %d frames, want 21", len(got))
+	}
+}
+
+func TestToPitchFrameRate(t *testing.T) {
+	pitch := []PitchType{60, 61, 62, 63, 64, 65, 66, 67, 68, 69}
+	voicing := []float64{0, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9}
+	// 2 seconds at 5 frames per second
+	got, gotVoicing := ToPitchFrameRate(pitch, voicing, 5)
+	if len(got) != 2*PitchFrameRate || len(gotVoicing) != len(got) {
+		t.Fatalf("got %d frames and %d voicing, want %d", len(got), len(gotVoicing), 2*PitchFrameRate)
+	}
+	for i, p := range got {
+		if k := int(p - 60); gotVoicing[i] != voicing[k] || k != i*5/PitchFrameRate {
+			t.Errorf("frame %d is %v voicing %v", i, p, gotVoicing[i])
+		}
+	}
+	if got, gotVoicing := ToPitchFrameRate(pitch, nil, PitchFrameRate); !reflect.DeepEqual(got, pitch) || gotVoicing != nil {
+		t.Errorf("same rate gives %v voicing %v", got, gotVoicing)
+	}
+}
+
+func TestFixOctave(t *testing.T) {
+	// a melody with an octave leap held long enough to be real
+	var clean []PitchType
+	for _, note := range []PitchType{60, 62, 64, 65, 67, 79, 77, 76, 74, 72} {
+		n := 8
+		if note >= 74 {
+			n = 20
+		}
+		for i := 0; i < n; i++ {
+			clean = append(clean, note+PitchType(i%3)*0.1)
+		}
+	}
+	noisy := make([]PitchType, len(clean))
+	copy(noisy, clean)
+	errors := []struct {
+		at, length int
+		shift      PitchType
+	}{
+		{3, 1, 12}, {10, 2, -12}, {25, 3, 12.4}, {33, 1, -24}, {50, 2, -12}, {86, 3, 11.6}, {108, 1, 12},
+	}
+	for _, e := range errors {
+		for i := e.at; i < e.at+e.length; i++ {
+			noisy[i] += e.shift
+		}
+	}
+	noisy[60] = -1
+	clean[60] = -1
+
+	opts := DefaultOctaveOptions()
+	got := FixOctave(noisy, &opts)
+	for i := range got {
+		// jumps off whole octaves fold to whole octaves
+		if math.Abs(float64(got[i]-clean[i])) > 0.41 {
+			t.Errorf("frame %d: got %v, want %v", i, got[i], clean[i])
+		}
+	}
+
+	// tolerance decides which jumps are octave errors
+	opts.Tolerance = 0.3
+	got = FixOctave(noisy, &opts)
+	if got[25] != noisy[25] || got[3] != clean[3] {
+		t.Errorf("with tolerance 0.3 got %v and %v", got[25], got[3])
+	}
+	// a window too short for the error keeps it
+	opts = OctaveOptions{Window: 2, Tolerance: 1}
+	if got = FixOctave(noisy, &opts); got[26] != noisy[26] {
+		t.Errorf("window 2 folds a 3 frame error to %v", got[26])
+	}
+
+	// FixPitch folds them too
+	fixed := FixPitch(noisy)
+	for i := range fixed {
+		if i != 60 && math.Abs(float64(fixed[i]-clean[i])) > 0.41 {
+			t.Errorf("FixPitch frame %d: got %v, want %v", i, fixed[i], clean[i])
+		}
+	}
+}
+
+func TestPitchOptions(t *testing.T) {
+	samples := make([]float64, 0)
+	for _, s := range hum([]float64{31, 36, 40}, 16000) {
+		samples = append(samples, float64(s))
+	}
+	opts := DefaultPitchOptions()
+	got, _, err := GetSamplesPitchWithOptions(samples, 16000, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := GetSamplesPitch2(samples, 16000); !reflect.DeepEqual(got, want) {
+		t.Errorf("default options give %v, GetSamplesPitch2 gives %v", got, want)
+	}
+	// 49Hz is below the default range
+	if math.Abs(float64(got[5])-31) < 0.3 {
+		t.Errorf("found %v below Fmin", got[5])
+	}
+
+	// a bass singer
+	opts.Fmin = 40
+	got, voicing, _ := GetSamplesPitchWithOptions(samples, 16000, opts)
+	for k, note := range []float64{31, 36, 40} {
+		if p := got[k*10+5]; math.Abs(float64(p)-note) > 0.3 {
+			t.Errorf("note %d: got pitch %v, want %v", k, p, note)
+		}
+	}
+
+	// output frames are medians of Downsample pYIN frames
+	opts.Downsample = 10
+	half, halfVoicing, _ := GetSamplesPitchWithOptions(samples, 16000, opts)
+	if len(half) != len(got)/2 || len(halfVoicing) != len(half) {
+		t.Errorf("Downsample 10 gives %d frames, want %d", len(half), len(got)/2)
+	}
+	if len(voicing) != len(got) {
+		t.Errorf("%d voicing frames for %d pitch frames", len(voicing), len(got))
+	}
+
+	bad := []func(*PitchOptions){
+		func(o *PitchOptions) { o.Fmin = 0 },
+		func(o *PitchOptions) { o.Fmax = 30 },
+		func(o *PitchOptions) { o.Fmax = AnalysisSampleRate },
+		func(o *PitchOptions) { o.NThresholds = 0 },
+		func(o *PitchOptions) { o.BetaParameters.Beta = 0 },
+		func(o *PitchOptions) { o.Resolution = 0 },
+		func(o *PitchOptions) { o.MaxTransitionRate = -1 },
+		func(o *PitchOptions) { o.VoicedProbability = 2 },
+		func(o *PitchOptions) { o.Downsample = 0 },
+	}
+	for i, change := range bad {
+		opts := DefaultPitchOptions()
+		change(&opts)
+		if opts.Validate() == nil {
+			t.Errorf("bad options %d pass Validate", i)
+		}
+	}
+	if _, _, err := GetReaderPitchWithOptions(bytes.NewReader(nil), PitchOptions{}); err == nil {
+		t.Error("zero options give no error")
+	}
+}
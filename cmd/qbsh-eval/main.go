@@ -0,0 +1,273 @@
+// qbsh-eval measures search accuracy on a MIR-QBSH style corpus:
+// ground truth songs are MIDI files named <song id>.mid, and queries are
+// .wav files (or .pv pitch vectors) named <song id>.wav in any
+// subdirectory, unless an answer list says otherwise.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stdio2016/qbsh"
+)
+
+// MIR-QBSH pitch vectors use 256 sample frames at 8 kHz
+const pvFrameRate = 8000.0 / 256
+
+type QueryResult struct {
+	Query    string  `json:"query"`
+	Expected string  `json:"expected"`
+	Top1     string  `json:"top1"`
+	Score    float64 `json:"score"`
+	// 1-based rank of the expected song, 0 if it was not returned
+	Rank     int     `json:"rank"`
+	PitchMs  float64 `json:"pitchMs"`
+	SearchMs float64 `json:"searchMs"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Songs        int           `json:"songs"`
+	Queries      int           `json:"queries"`
+	Top1         float64       `json:"top1"`
+	Top10        float64       `json:"top10"`
+	MRR          float64       `json:"mrr"`
+	MeanPitchMs  float64       `json:"meanPitchMs"`
+	MeanSearchMs float64       `json:"meanSearchMs"`
+	Results      []QueryResult `json:"results"`
+}
+
+func main() {
+	midiDir := flag.String("midi", "", "directory of ground truth MIDI files")
+	queryDir := flag.String("queries", "", "directory searched recursively for queries")
+	answers := flag.String("answers", "", "file of \"<query path> <song id>\" lines, paths relative to -queries")
+	usePv := flag.Bool("pv", false, "use .pv pitch vectors instead of .wav files")
+	jsonOut := flag.String("json", "", "write the report as JSON to this file")
+	limit := flag.Int("limit", 0, "evaluate at most this many queries")
+	filter := flag.Bool("filter", false, "apply the default search cut-offs, so the expected song may be missing")
+	candidates := flag.Int("candidates", 0, "compare only this many songs picked by linear scaling with DTW, 0 compares all")
+	noteWeight := flag.Float64("note-weight", 0, "weight of note matching in the score, from 0 to 1")
+	keyInvariant := flag.Bool("key-invariant", false, "compare relative pitch instead of shifting the query to each pitch range")
+	flag.Parse()
+	if *midiDir == "" || *queryDir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	db := qbsh.InitDatabase()
+	imports, err := db.AddFromMIDIDir(*midiDir)
+	if err != nil {
+		log.Println(err)
+	}
+	log.Printf("loaded %d songs\n", len(imports))
+
+	queries, err := findQueries(*queryDir, *answers, *usePv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *limit > 0 && len(queries) > *limit {
+		queries = queries[:*limit]
+	}
+
+	opts := qbsh.DefaultSearchOptions()
+	opts.NoFilter = !*filter
+	if !*filter {
+		opts.TopK = 0
+	}
+	opts.LinearScaling.Candidates = *candidates
+	opts.NoteMatch.Weight = *noteWeight
+	opts.KeyInvariant = *keyInvariant
+	report := Report{Songs: len(imports)}
+	for i, q := range queries {
+		res := runQuery(db, *queryDir, q, *usePv, opts)
+		report.Results = append(report.Results, res)
+		log.Printf("%d/%d %s rank %d\n", i+1, len(queries), q.path, res.Rank)
+	}
+	report.finish()
+
+	printTable(os.Stdout, &report)
+	if *jsonOut != "" {
+		b, _ := json.MarshalIndent(report, "", "  ")
+		if err := os.WriteFile(*jsonOut, b, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+type query struct {
+	path     string
+	expected string
+}
+
+func findQueries(dir, answers string, usePv bool) ([]query, error) {
+	if answers != "" {
+		return readAnswers(answers)
+	}
+	ext := ".wav"
+	if usePv {
+		ext = ".pv"
+	}
+	var queries []query
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.ToLower(filepath.Ext(path)) != ext {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(path)
+		queries = append(queries, query{rel, strings.TrimSuffix(name, filepath.Ext(name))})
+		return nil
+	})
+	sort.Slice(queries, func(i, j int) bool {
+		return queries[i].path < queries[j].path
+	})
+	return queries, err
+}
+
+func readAnswers(path string) ([]query, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var queries []query
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad answer line %q", scanner.Text())
+		}
+		queries = append(queries, query{fields[0], fields[1]})
+	}
+	return queries, scanner.Err()
+}
+
+// readPitchVector reads a .pv file, pvFrameRate frames per second
+func readPitchVector(path string) ([]qbsh.PitchType, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pv []qbsh.PitchType
+	for _, tok := range strings.Fields(string(data)) {
+		n, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			n = -1
+		}
+		pv = append(pv, qbsh.PitchType(n))
+	}
+	return pv, nil
+}
+
+func runQuery(db *qbsh.Database, dir string, q query, usePv bool, opts qbsh.SearchOptions) QueryResult {
+	res := QueryResult{
+		Query:    q.path,
+		Expected: q.expected,
+	}
+	path := filepath.Join(dir, q.path)
+	time_1 := time.Now()
+	var pitch []qbsh.PitchType
+	var voicing []float64
+	var err error
+	rate := pvFrameRate
+	if usePv {
+		pitch, err = readPitchVector(path)
+	} else {
+		pitchOpts := qbsh.DefaultPitchOptions()
+		rate = pitchOpts.FrameRate()
+		pitch, voicing, err = qbsh.GetWavPitchWithOptions(path, pitchOpts)
+	}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	pitch, voicing = qbsh.ToPitchFrameRate(pitch, voicing, rate)
+	pitch = qbsh.FixPitchVoicing(pitch, voicing)
+	if len(pitch) == 0 {
+		res.Error = "no pitch found"
+		return res
+	}
+	time_2 := time.Now()
+	result := db.SearchWithOptions(pitch, opts)
+	time_3 := time.Now()
+	res.PitchMs = float64(time_2.Sub(time_1).Microseconds()) / 1000
+	res.SearchMs = float64(time_3.Sub(time_2).Microseconds()) / 1000
+	if len(result.Songs) > 0 {
+		res.Top1 = result.Songs[0].SongId
+		res.Score = float64(result.Songs[0].Score)
+	}
+	for i, song := range result.Songs {
+		if song.SongId == q.expected {
+			res.Rank = i + 1
+			break
+		}
+	}
+	return res
+}
+
+func (r *Report) finish() {
+	r.Queries = len(r.Results)
+	if r.Queries == 0 {
+		return
+	}
+	for _, res := range r.Results {
+		if res.Rank == 1 {
+			r.Top1++
+		}
+		if res.Rank >= 1 && res.Rank <= 10 {
+			r.Top10++
+		}
+		if res.Rank > 0 {
+			r.MRR += 1 / float64(res.Rank)
+		}
+		r.MeanPitchMs += res.PitchMs
+		r.MeanSearchMs += res.SearchMs
+	}
+	n := float64(r.Queries)
+	r.Top1 /= n
+	r.Top10 /= n
+	r.MRR /= n
+	r.MeanPitchMs /= n
+	r.MeanSearchMs /= n
+}
+
+func printTable(out *os.File, r *Report) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "query\texpected\ttop1\tscore\trank\tpitch ms\tsearch ms\t")
+	for _, res := range r.Results {
+		rank := strconv.Itoa(res.Rank)
+		if res.Error != "" {
+			rank = res.Error
+		} else if res.Rank == 0 {
+			rank = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.1f\t%s\t%.1f\t%.1f\t\n",
+			res.Query, res.Expected, res.Top1, res.Score, rank, res.PitchMs, res.SearchMs)
+	}
+	w.Flush()
+	fmt.Fprintf(out, "\nsongs %d queries %d\n", r.Songs, r.Queries)
+	fmt.Fprintf(out, "top-1 %.2f%% top-10 %.2f%% MRR %.4f\n", r.Top1*100, r.Top10*100, r.MRR)
+	fmt.Fprintf(out, "mean pitch %.1fms mean search %.1fms\n", r.MeanPitchMs, r.MeanSearchMs)
+}
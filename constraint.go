@@ -0,0 +1,191 @@
+package qbsh
+
+// DTWConstraint limits how far DTW may warp the query. The zero value
+// allows any warping, like DTW and DTW_simd.
+type DTWConstraint struct {
+	// Sakoe-Chiba band: query frame j may only match song frames within
+	// Band frames of start+j, where start is the song frame matched to
+	// the first query frame. 0 means no band. A band wider than the query
+	// is narrowed to the query length. The band does not make DTW
+	// cheaper: its time and memory grow with 2*Band+1
+	Band int
+	// use the steps (1,1), (2,1) and (1,2) instead of (1,0), (1,1) and
+	// (0,1), so the query tempo stays between half and twice the song
+	LimitSlope bool
+}
+
+// IsZero tells whether c allows any warping
+func (c DTWConstraint) IsZero() bool {
+	return c.Band <= 0 && !c.LimitSlope
+}
+
+const dtwInf PitchType = 999999.0
+
+// dtwCell is a cell of the constrained DTW table
+type dtwCell struct {
+	Score PitchType
+	// song frame matched to the first query frame, -1 if unreachable
+	Start int
+	// distance between the song frame and query frame of this cell
+	Cost PitchType
+}
+
+var dtwUnreachable = dtwCell{dtwInf, -1, 0}
+
+// forQuery narrows the band to the length n of the query, so that the
+// DTW table stays at most 2n+1 states wide
+func (c DTWConstraint) forQuery(n int) DTWConstraint {
+	if c.Band > n {
+		c.Band = n
+	}
+	return c
+}
+
+// states returns the number of states in each cell of the DTW table.
+// With a band, state k holds the best path whose offset i - j - start is
+// k - Band, so paths from different starts are kept apart and the band
+// is exact. Without a band one state is enough.
+func (c *DTWConstraint) states() int {
+	if c.Band > 0 {
+		return 2*c.Band + 1
+	}
+	return 1
+}
+
+// prev returns the state at cell (i+di, j+dj) of a path that is in state k
+// at cell (i, j)
+func (c *DTWConstraint) prev(k, di, dj int) int {
+	if c.Band > 0 {
+		return k + di - dj
+	}
+	return 0
+}
+
+// at returns state k of cell (i, j) from buf, which holds the cells of
+// row i indexed by j*states()+k. Row -1 is before the first query frame,
+// where a match may start at any song frame with offset 0.
+func (c *DTWConstraint) at(buf []dtwCell, i, j, k int) dtwCell {
+	w := c.states()
+	if k < 0 || k >= w {
+		return dtwUnreachable
+	}
+	if j == -1 && i >= -1 {
+		if c.Band > 0 && k != c.Band {
+			return dtwUnreachable
+		}
+		return dtwCell{0, i + 1, 0}
+	}
+	if j < 0 || i < 0 {
+		return dtwUnreachable
+	}
+	return buf[j*w+k]
+}
+
+// cell computes state k of cell (i, j) of the DTW table. left, diag, up,
+// h2 and v2 hold the rows of cells (i-1, j), (i-1, j-1), (i, j-1),
+// (i-2, j-1) and (i-1, j-2). cost is the distance at (i, j).
+func (c *DTWConstraint) cell(i, j, k int, left, diag, up, h2, v2 []dtwCell, cost PitchType) dtwCell {
+	best := dtwUnreachable
+	w := c.states()
+	if c.LimitSlope {
+		pick(&best, c.at(diag, i-1, j-1, c.prev(k, -1, -1)), 0)
+		if i >= 1 {
+			pick(&best, c.at(h2, i-2, j-1, c.prev(k, -2, -1)), left[j*w].Cost)
+		}
+		if j >= 1 {
+			pick(&best, c.at(v2, i-1, j-2, c.prev(k, -1, -2)), up[(j-1)*w].Cost)
+		}
+	} else {
+		pick(&best, c.at(left, i-1, j, c.prev(k, -1, 0)), 0)
+		pick(&best, c.at(diag, i-1, j-1, c.prev(k, -1, -1)), 0)
+		if j >= 1 {
+			pick(&best, c.at(up, i, j-1, c.prev(k, 0, -1)), 0)
+		}
+	}
+	if best.Start >= 0 {
+		best.Score += cost
+	}
+	best.Cost = cost
+	return best
+}
+
+// pick replaces best with cand plus the cost of the cell passed on the way
+// if it is better
+func pick(best *dtwCell, cand dtwCell, via PitchType) {
+	if cand.Start < 0 {
+		return
+	}
+	score := cand.Score + via
+	if best.Start < 0 || score < best.Score {
+		best.Score = score
+		best.Start = cand.Start
+	}
+}
+
+func dtwCost(a, b PitchType) PitchType {
+	diff := a - b
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff
+}
+
+// DTW_constrained is DTW with warping limited by c
+func DTW_constrained(song []PitchType, query []PitchType, shift PitchType, c DTWConstraint) PitchType {
+	ans, _, _ := DTW_find_where_constrained(song, query, shift, c)
+	return ans
+}
+
+// DTW_find_where_constrained is DTW_find_where with warping limited by c.
+// from and to are the song frames matched to the first and last query
+// frame.
+func DTW_find_where_constrained(song []PitchType, query []PitchType, shift PitchType, c DTWConstraint) (PitchType, int, int) {
+	var d DTW_tmp
+	return d.dtwConstrained(song, query, shift, c)
+}
+
+// DTW_range_constrained is DTW_simd with warping limited by c. It runs
+// dtwLanes starts or song frames at a time on the SIMD kernels, and gives
+// the same score as DTW_constrained.
+func (d *DTW_tmp) DTW_range_constrained(song *Song, query []PitchType, from, to int, shift PitchType, c DTWConstraint) PitchType {
+	if c.IsZero() {
+		return d.DTW_simd(song, query, from, to, shift)
+	}
+	return d.dtwSimdConstrained(song.Pitch[from:to], query, shift, c)
+}
+
+func (d *DTW_tmp) dtwConstrained(song []PitchType, query []PitchType, shift PitchType, c DTWConstraint) (PitchType, int, int) {
+	n1 := len(song)
+	n2 := len(query)
+	ans := dtwInf
+	from, to := 0, 0
+	if n2 == 0 {
+		return ans, from, to
+	}
+	c = c.forQuery(n2)
+	w := c.states()
+	size := n2 * w
+	if len(d.Cells) < 3*size {
+		d.Cells = make([]dtwCell, 3*size)
+	}
+	row2 := d.Cells[:size]
+	row1 := d.Cells[size : 2*size]
+	cur := d.Cells[2*size : 3*size]
+	for i := 0; i < n1; i++ {
+		for j := 0; j < n2; j++ {
+			cost := dtwCost(song[i], query[j]-shift)
+			for k := 0; k < w; k++ {
+				cur[j*w+k] = c.cell(i, j, k, row1, row1, cur, row2, row1, cost)
+			}
+		}
+		for _, last := range cur[(n2-1)*w:] {
+			if last.Start >= 0 && last.Score < ans {
+				ans = last.Score
+				from = last.Start
+				to = i
+			}
+		}
+		row2, row1, cur = row1, cur, row2
+	}
+	return ans, from, to
+}
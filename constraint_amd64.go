@@ -0,0 +1,46 @@
+//go:build amd64
+
+package qbsh
+
+// dtwAbsDiff sets vector v of out, dtwLanes floats, to the distance from
+// q to the dtwLanes song frames from v*stride, for n vectors
+func dtwAbsDiff(out, song []PitchType, q PitchType, n, stride int) {
+	if dtwHasAVX2 {
+		dtwAbsDiffAVX2(out, song, q, n, stride)
+	} else {
+		dtwAbsDiffSSE(out, song, q, n, stride)
+	}
+}
+
+// dtwBandRow computes vectors 1 to n of a band row, each the minimum of
+// the vector before it in cur and of the same and next vector in prev,
+// plus cost
+func dtwBandRow(cur, prev, cost []PitchType, n int) {
+	if dtwHasAVX2 {
+		dtwBandRowAVX2(cur, prev, cost, n)
+	} else {
+		dtwBandRowSSE(cur, prev, cost, n)
+	}
+}
+
+// dtwSlopeRow sets n vectors of out to the minimum of diag, h2+hc and
+// v2+vc, plus cost
+func dtwSlopeRow(out, diag, h2, hc, v2, vc, cost []PitchType, n int) {
+	if dtwHasAVX2 {
+		dtwSlopeRowAVX2(out, diag, h2, hc, v2, vc, cost, n)
+	} else {
+		dtwSlopeRowSSE(out, diag, h2, hc, v2, vc, cost, n)
+	}
+}
+
+func dtwAbsDiffAVX2(out, song []PitchType, q PitchType, n, stride int)
+
+func dtwAbsDiffSSE(out, song []PitchType, q PitchType, n, stride int)
+
+func dtwBandRowAVX2(cur, prev, cost []PitchType, n int)
+
+func dtwBandRowSSE(cur, prev, cost []PitchType, n int)
+
+func dtwSlopeRowAVX2(out, diag, h2, hc, v2, vc, cost []PitchType, n int)
+
+func dtwSlopeRowSSE(out, diag, h2, hc, v2, vc, cost []PitchType, n int)
@@ -0,0 +1,206 @@
+#include "textflag.h"
+DATA absmask<>+0x00(SB)/4, $0x7fffffff
+DATA absmask<>+0x04(SB)/4, $0x7fffffff
+DATA absmask<>+0x08(SB)/4, $0x7fffffff
+DATA absmask<>+0x0c(SB)/4, $0x7fffffff
+GLOBL absmask<>(SB), (RODATA+NOPTR), $16
+
+// a vector is dtwLanes = 8 floats, one YMM register or two XMM registers
+
+// func dtwAbsDiffAVX2(out, song []PitchType, q PitchType, n, stride int)
+TEXT ·dtwAbsDiffAVX2(SB),NOSPLIT,$0-72
+	// DI = out
+	MOVQ out_base+0(FP), DI
+	// SI = song
+	MOVQ song_base+24(FP), SI
+	// Y1 = q
+	VBROADCASTSS q+48(FP), Y1
+	// CX = n
+	MOVQ n+56(FP), CX
+	// DX = stride in bytes
+	MOVQ stride+64(FP), DX
+	SHLQ $2, DX
+	// Y15 = mask to clear sign bit
+	VBROADCASTSS absmask<>(SB), Y15
+	CMPQ CX, $0
+	JLE avx2_absdiff_done
+avx2_absdiff_loop:
+	// out[v] = |song[v*stride] - q|
+	VMOVUPS (SI), Y0
+	VSUBPS Y1, Y0, Y0
+	VANDPS Y15, Y0, Y0
+	VMOVUPS Y0, (DI)
+	ADDQ $32, DI
+	ADDQ DX, SI
+	DECQ CX
+	JNZ avx2_absdiff_loop
+avx2_absdiff_done:
+	VZEROUPPER
+	RET
+
+// func dtwAbsDiffSSE(out, song []PitchType, q PitchType, n, stride int)
+TEXT ·dtwAbsDiffSSE(SB),NOSPLIT,$0-72
+	MOVQ out_base+0(FP), DI
+	MOVQ song_base+24(FP), SI
+	MOVSS q+48(FP), X1
+	SHUFPS $0, X1, X1
+	MOVQ n+56(FP), CX
+	MOVQ stride+64(FP), DX
+	SHLQ $2, DX
+	MOVUPS absmask<>(SB), X15
+	CMPQ CX, $0
+	JLE sse_absdiff_done
+sse_absdiff_loop:
+	// same as AVX2 version in two halves
+	MOVUPS (SI), X0
+	MOVUPS 16(SI), X2
+	SUBPS X1, X0
+	SUBPS X1, X2
+	ANDPS X15, X0
+	ANDPS X15, X2
+	MOVUPS X0, (DI)
+	MOVUPS X2, 16(DI)
+	ADDQ $32, DI
+	ADDQ DX, SI
+	DECQ CX
+	JNZ sse_absdiff_loop
+sse_absdiff_done:
+	RET
+
+// func dtwBandRowAVX2(cur, prev, cost []PitchType, n int)
+TEXT ·dtwBandRowAVX2(SB),NOSPLIT,$0-80
+	// DI = cur
+	MOVQ cur_base+0(FP), DI
+	// SI = prev
+	MOVQ prev_base+24(FP), SI
+	// DX = cost
+	MOVQ cost_base+48(FP), DX
+	// CX = n
+	MOVQ n+72(FP), CX
+	CMPQ CX, $0
+	JLE avx2_band_done
+	// Y0 = v := cur[0]
+	VMOVUPS (DI), Y0
+avx2_band_loop:
+	// Y1 = min(prev[x], prev[x+1])
+	VMOVUPS 32(SI), Y1
+	VMINPS 64(SI), Y1, Y1
+	// v = min(v, Y1) + cost[x]
+	VMINPS Y1, Y0, Y0
+	VADDPS 32(DX), Y0, Y0
+	// cur[x] = v
+	VMOVUPS Y0, 32(DI)
+	ADDQ $32, DI
+	ADDQ $32, SI
+	ADDQ $32, DX
+	DECQ CX
+	JNZ avx2_band_loop
+avx2_band_done:
+	VZEROUPPER
+	RET
+
+// func dtwBandRowSSE(cur, prev, cost []PitchType, n int)
+TEXT ·dtwBandRowSSE(SB),NOSPLIT,$0-80
+	MOVQ cur_base+0(FP), DI
+	MOVQ prev_base+24(FP), SI
+	MOVQ cost_base+48(FP), DX
+	MOVQ n+72(FP), CX
+	CMPQ CX, $0
+	JLE sse_band_done
+	// X0, X4 = v := cur[0]
+	MOVUPS (DI), X0
+	MOVUPS 16(DI), X4
+sse_band_loop:
+	// same as AVX2 version in two halves
+	MOVUPS 32(SI), X1
+	MOVUPS 64(SI), X2
+	MOVUPS 48(SI), X5
+	MOVUPS 80(SI), X6
+	MINPS X2, X1
+	MINPS X6, X5
+	MINPS X1, X0
+	MINPS X5, X4
+	MOVUPS 32(DX), X3
+	MOVUPS 48(DX), X7
+	ADDPS X3, X0
+	ADDPS X7, X4
+	MOVUPS X0, 32(DI)
+	MOVUPS X4, 48(DI)
+	ADDQ $32, DI
+	ADDQ $32, SI
+	ADDQ $32, DX
+	DECQ CX
+	JNZ sse_band_loop
+sse_band_done:
+	RET
+
+// func dtwSlopeRowAVX2(out, diag, h2, hc, v2, vc, cost []PitchType, n int)
+TEXT ·dtwSlopeRowAVX2(SB),NOSPLIT,$0-176
+	MOVQ out_base+0(FP), DI
+	MOVQ diag_base+24(FP), R8
+	MOVQ h2_base+48(FP), R9
+	MOVQ hc_base+72(FP), R10
+	MOVQ v2_base+96(FP), R11
+	MOVQ vc_base+120(FP), R12
+	MOVQ cost_base+144(FP), R13
+	// CX = n
+	MOVQ n+168(FP), CX
+	// AX = byte offset of vector
+	XORQ AX, AX
+	CMPQ CX, $0
+	JLE avx2_slope_done
+avx2_slope_loop:
+	// Y0 = v := diag[e]
+	VMOVUPS (R8)(AX*1), Y0
+	// v = min(v, h2[e] + hc[e])
+	VMOVUPS (R9)(AX*1), Y1
+	VADDPS (R10)(AX*1), Y1, Y1
+	VMINPS Y1, Y0, Y0
+	// v = min(v, v2[e] + vc[e])
+	VMOVUPS (R11)(AX*1), Y2
+	VADDPS (R12)(AX*1), Y2, Y2
+	VMINPS Y2, Y0, Y0
+	// out[e] = v + cost[e]
+	VADDPS (R13)(AX*1), Y0, Y0
+	VMOVUPS Y0, (DI)(AX*1)
+	ADDQ $32, AX
+	DECQ CX
+	JNZ avx2_slope_loop
+avx2_slope_done:
+	VZEROUPPER
+	RET
+
+// func dtwSlopeRowSSE(out, diag, h2, hc, v2, vc, cost []PitchType, n int)
+TEXT ·dtwSlopeRowSSE(SB),NOSPLIT,$0-176
+	MOVQ out_base+0(FP), DI
+	MOVQ diag_base+24(FP), R8
+	MOVQ h2_base+48(FP), R9
+	MOVQ hc_base+72(FP), R10
+	MOVQ v2_base+96(FP), R11
+	MOVQ vc_base+120(FP), R12
+	MOVQ cost_base+144(FP), R13
+	// CX = 2*n halves of 4 floats
+	MOVQ n+168(FP), CX
+	SHLQ $1, CX
+	XORQ AX, AX
+	CMPQ CX, $0
+	JLE sse_slope_done
+sse_slope_loop:
+	// same as AVX2 version with 4 floats
+	MOVUPS (R8)(AX*1), X0
+	MOVUPS (R9)(AX*1), X1
+	MOVUPS (R10)(AX*1), X3
+	ADDPS X3, X1
+	MINPS X1, X0
+	MOVUPS (R11)(AX*1), X2
+	MOVUPS (R12)(AX*1), X4
+	ADDPS X4, X2
+	MINPS X2, X0
+	MOVUPS (R13)(AX*1), X5
+	ADDPS X5, X0
+	MOVUPS X0, (DI)(AX*1)
+	ADDQ $16, AX
+	DECQ CX
+	JNZ sse_slope_loop
+sse_slope_done:
+	RET
@@ -0,0 +1,180 @@
+package qbsh
+
+import "math"
+
+// dtwLanes is the number of floats the constrained DTW kernels handle at
+// once. With a band, lane l of a vector belongs to start frame s0+l, and
+// a row holds one vector per offset in the band. With only LimitSlope,
+// no cell of a row depends on another cell of the same row, so the lanes
+// are consecutive song frames.
+const dtwLanes = 8
+
+// dtwAbsDiffGo is dtwAbsDiff in Go
+func dtwAbsDiffGo(out, song []PitchType, q PitchType, n, stride int) {
+	for v := 0; v < n; v++ {
+		o := out[v*dtwLanes : (v+1)*dtwLanes]
+		s := song[v*stride : v*stride+dtwLanes]
+		for l := range o {
+			o[l] = dtwCost(s[l], q)
+		}
+	}
+}
+
+// dtwBandRowGo is dtwBandRow in Go
+func dtwBandRowGo(cur, prev, cost []PitchType, n int) {
+	for e := dtwLanes; e < (n+1)*dtwLanes; e++ {
+		v := cur[e-dtwLanes]
+		if prev[e] < v {
+			v = prev[e]
+		}
+		if prev[e+dtwLanes] < v {
+			v = prev[e+dtwLanes]
+		}
+		cur[e] = v + cost[e]
+	}
+}
+
+// dtwSlopeRowGo is dtwSlopeRow in Go
+func dtwSlopeRowGo(out, diag, h2, hc, v2, vc, cost []PitchType, n int) {
+	for e := 0; e < n*dtwLanes; e++ {
+		v := diag[e]
+		if h := h2[e] + hc[e]; h < v {
+			v = h
+		}
+		if u := v2[e] + vc[e]; u < v {
+			v = u
+		}
+		out[e] = v + cost[e]
+	}
+}
+
+// lanes returns n floats of scratch space from d
+func (d *DTW_tmp) lanes(n int) []PitchType {
+	if len(d.Lanes) < n {
+		d.Lanes = make([]PitchType, n)
+	}
+	return d.Lanes[:n]
+}
+
+func fillPitch(buf []PitchType, v PitchType) {
+	for i := range buf {
+		buf[i] = v
+	}
+}
+
+// dtwSimdConstrained is dtwConstrained without the match position, on the
+// SIMD kernels
+func (d *DTW_tmp) dtwSimdConstrained(song []PitchType, query []PitchType, shift PitchType, c DTWConstraint) PitchType {
+	if len(song) == 0 || len(query) == 0 {
+		return dtwInf
+	}
+	c = c.forQuery(len(query))
+	var ans PitchType
+	if c.Band > 0 {
+		ans = d.dtwBandLanes(song, query, shift, c.Band, c.LimitSlope)
+	} else {
+		ans = d.dtwSlopeLanes(song, query, shift)
+	}
+	if ans >= dtwInf {
+		return dtwInf
+	}
+	return ans
+}
+
+// dtwBandLanes runs the banded DTW of dtwLanes start frames at a time.
+// Rows have a vector for each offset from -band to band, and a guard
+// vector on each side.
+func (d *DTW_tmp) dtwBandLanes(song []PitchType, query []PitchType, shift PitchType, band int, slope bool) PitchType {
+	n1, n2 := len(song), len(query)
+	L := dtwLanes
+	w := 2*band + 1
+	rowLen := (w + 2) * L
+	// song frame i is padded[i+band], frames outside the song cost
+	// infinity
+	padLen := n1 + n2 + 2*band + L
+	buf := d.lanes(5*rowLen + padLen)
+	prev2 := buf[:rowLen]
+	prev := buf[rowLen : 2*rowLen]
+	cur := buf[2*rowLen : 3*rowLen]
+	prevCost := buf[3*rowLen : 4*rowLen]
+	cost := buf[4*rowLen : 5*rowLen]
+	padded := buf[5*rowLen:]
+	inf := PitchType(math.Inf(1))
+	fillPitch(padded, inf)
+	copy(padded[band:], song)
+	// guards of cost rows are never written
+	fillPitch(prevCost, 0)
+	fillPitch(cost, 0)
+
+	ans := inf
+	for s0 := 0; s0 < n1; s0 += L {
+		// row -2 is unreachable, and row -1 is the start at offset 0
+		fillPitch(prev2, inf)
+		fillPitch(prev, inf)
+		fillPitch(cur, inf)
+		fillPitch(prev[(band+1)*L:(band+2)*L], 0)
+		for j := 0; j < n2; j++ {
+			dtwAbsDiff(cost[L:], padded[s0+j:], query[j]-shift, w, 1)
+			if slope {
+				dtwSlopeRow(cur[L:], prev[L:], prev, cost, prev2[2*L:], prevCost[2*L:], cost[L:], w)
+			} else {
+				dtwBandRow(cur, prev, cost, w)
+				if j == 0 {
+					// no step up from before the first query frame
+					fillPitch(cur[band*L:(band+1)*L], inf)
+				}
+			}
+			prev2, prev, cur = prev, cur, prev2
+			prevCost, cost = cost, prevCost
+		}
+		for _, v := range prev[L : (w+1)*L] {
+			if v < ans {
+				ans = v
+			}
+		}
+	}
+	return ans
+}
+
+// dtwSlopeLanes runs DTW with LimitSlope and no band row by row, with
+// the lanes along the song. Rows start with the guard cells of song
+// frames -2 and -1.
+func (d *DTW_tmp) dtwSlopeLanes(song []PitchType, query []PitchType, shift PitchType) PitchType {
+	n1, n2 := len(song), len(query)
+	L := dtwLanes
+	const guard = 2
+	nvec := (n1 + L - 1) / L
+	rowLen := guard + nvec*L
+	buf := d.lanes(5*rowLen + nvec*L)
+	prev2 := buf[:rowLen]
+	prev := buf[rowLen : 2*rowLen]
+	cur := buf[2*rowLen : 3*rowLen]
+	prevCost := buf[3*rowLen : 4*rowLen]
+	cost := buf[4*rowLen : 5*rowLen]
+	padded := buf[5*rowLen:]
+	inf := PitchType(math.Inf(1))
+	fillPitch(padded, inf)
+	copy(padded, song)
+	fillPitch(prevCost, 0)
+	fillPitch(cost, 0)
+	// row -2 is unreachable, and a match may start after any song frame
+	// from -1 on
+	fillPitch(prev2, inf)
+	fillPitch(prev, 0)
+	prev[0] = inf
+
+	for j := 0; j < n2; j++ {
+		dtwAbsDiff(cost[guard:], padded, query[j]-shift, nvec, L)
+		dtwSlopeRow(cur[guard:], prev[guard-1:], prev[guard-2:], cost[guard-1:], prev2[guard-1:], prevCost[guard:], cost[guard:], nvec)
+		cur[0], cur[1] = inf, inf
+		prev2, prev, cur = prev, cur, prev2
+		prevCost, cost = cost, prevCost
+	}
+	ans := inf
+	for _, v := range prev[guard : guard+n1] {
+		if v < ans {
+			ans = v
+		}
+	}
+	return ans
+}
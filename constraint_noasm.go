@@ -0,0 +1,15 @@
+//go:build !amd64
+
+package qbsh
+
+func dtwAbsDiff(out, song []PitchType, q PitchType, n, stride int) {
+	dtwAbsDiffGo(out, song, q, n, stride)
+}
+
+func dtwBandRow(cur, prev, cost []PitchType, n int) {
+	dtwBandRowGo(cur, prev, cost, n)
+}
+
+func dtwSlopeRow(out, diag, h2, hc, v2, vc, cost []PitchType, n int) {
+	dtwSlopeRowGo(out, diag, h2, hc, v2, vc, cost, n)
+}
@@ -1,16 +1,21 @@
 package qbsh
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"math"
 	"os"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type PitchType float32
 
+var ErrSongNotFound = errors.New("song not found")
+
 type Song struct {
 	Name         string
 	Pitch        []PitchType
@@ -20,6 +25,49 @@ type Song struct {
 	High         PitchType
 	Ranges       []SongPitchRange
 	PitchForSimd []PitchType
+	// notes and relative pitch, computed on first use
+	derived *songDerived
+}
+
+// songDerived holds data computed from the pitch of a song on first use,
+// so loading a database stays fast and unused data takes no memory
+type songDerived struct {
+	pitch        []PitchType
+	notesOnce    sync.Once
+	notes        []Note
+	relativeOnce sync.Once
+	relative     []PitchType
+	relativeSimd []PitchType
+}
+
+func newSongDerived(pitch []PitchType) *songDerived {
+	return &songDerived{pitch: pitch}
+}
+
+// Notes returns the notes of the song pitch, for note matching
+func (song *Song) Notes() []Note {
+	d := song.derived
+	if d == nil {
+		return SegmentNotes(song.Pitch, DefaultNoteOptions())
+	}
+	d.notesOnce.Do(func() {
+		d.notes = SegmentNotes(d.pitch, DefaultNoteOptions())
+	})
+	return d.notes
+}
+
+// relative returns RelativePitch of the song pitch and its SIMD layout,
+// for key invariant search
+func (song *Song) relative() ([]PitchType, []PitchType) {
+	d := song.derived
+	if d == nil {
+		d = newSongDerived(song.Pitch)
+	}
+	d.relativeOnce.Do(func() {
+		d.relative = RelativePitch(d.pitch)
+		d.relativeSimd = ProcessSongForSimd(d.relative)
+	})
+	return d.relative, d.relativeSimd
 }
 
 type SongPitchRange struct {
@@ -31,6 +79,8 @@ type SongPitchRange struct {
 type Database struct {
 	Songs map[string]*Song
 	Lock  sync.RWMutex
+	// changes are logged here when it is not nil
+	Journal *Journal
 }
 
 type SongScore struct {
@@ -40,15 +90,104 @@ type SongScore struct {
 	Artist string    `json:"singer"`
 	From   int
 	To     int
+	// filled when SearchOptions.Alignment is set
+	Alignment []AlignmentStep `json:"alignment,omitempty"`
+	// note distance, when note matching is on
+	NoteScore PitchType `json:"noteScore,omitempty"`
+}
+
+// SearchOptions controls which results are returned. Results are sorted
+// by score, lower is better, and the list stops at the first result
+// hitting any cut-off.
+type SearchOptions struct {
+	// maximum number of results, 0 means no limit
+	TopK int
+	// drop results with score above MaxScore, 0 means no limit
+	MaxScore PitchType
+	// drop results worse than AverageCutoff times the average score of all
+	// songs, unless the score is at most AverageFloor. 0 disables it
+	AverageCutoff float64
+	AverageFloor  PitchType
+	// drop results worse than RelativeCutoff times the best score,
+	// 0 disables it
+	RelativeCutoff float64
+	// drop results worse than StdDevCutoff standard deviations below the
+	// average score, 0 disables it
+	StdDevCutoff float64
+	// ignore all cut-offs except TopK
+	NoFilter bool
+	// fill Result.Debug
+	Debug bool
+	// number of goroutines comparing songs, 0 means GOMAXPROCS
+	Parallelism int
+	// skip pitch ranges whose lower bound is worse than the TopK-th best
+	// score so far. AverageCutoff and StdDevCutoff need the score of every
+	// song, so with them only ranges that cannot beat the best range of
+	// their own song are skipped. The bound is the distance from the
+	// query to the pitch envelope of a range, which is about 0 for a range
+	// transposed to the query, so this is usually slower than not pruning
+	Prune bool
+	// with Prune, also stop DTW once its score must be too high. This
+	// DTW cannot use SIMD, so it helps only when most ranges are hopeless
+	EarlyAbandon bool
+	// limit warping of the query, the zero value allows any warping.
+	// EarlyAbandon is ignored with a constraint
+	Constraint DTWConstraint
+	// fill SongScore.Alignment with the warping path of the best
+	// MaxAlignments results, 0 means all results
+	Alignment     bool
+	MaxAlignments int
+	// compare only the best songs by linear scaling with DTW
+	LinearScaling LinearScalingOptions
+	// mix note distance into the score of songs compared by DTW. The note
+	// distance is scaled so that its average equals the average DTW score
+	NoteMatch NoteMatchOptions
+	// compare RelativePitch of query and songs with one DTW per song,
+	// instead of one DTW per pitch range shifted to its median
+	KeyInvariant bool
+}
+
+type SearchDebug struct {
+	Average float64 `json:"average"`
+	StdDev  float64 `json:"stdev"`
+	// number of songs in database
+	Songs int `json:"songs"`
+	// number of songs long enough to match the query
+	Matched int `json:"matched"`
+	// number of pitch ranges of all songs
+	Ranges int `json:"ranges"`
+	// ranges skipped by lower bound
+	Pruned int `json:"pruned"`
+	// ranges whose DTW stopped early
+	Abandoned int `json:"abandoned"`
+	// songs not compared by DTW due to linear scaling
+	Filtered int `json:"filtered"`
 }
 
 type Result struct {
 	// progress must be "100" to indicate success
 	// or "error" to indicate error
-	Progress string      `json:"progress"`
-	Pitch    []PitchType `json:"pitch"`
-	Songs    []SongScore `json:"songs"`
-	Reason   string      `json:"reason"`
+	Progress string       `json:"progress"`
+	Pitch    []PitchType  `json:"pitch"`
+	Songs    []SongScore  `json:"songs"`
+	Reason   string       `json:"reason"`
+	Debug    *SearchDebug `json:"debug,omitempty"`
+}
+
+// score of songs too short to be compared
+const noMatchScore PitchType = 99999.0
+
+// DefaultSearchOptions are the options used by Search
+func DefaultSearchOptions() SearchOptions {
+	return SearchOptions{
+		TopK:           100,
+		MaxAlignments:  10,
+		AverageCutoff:  0.8,
+		AverageFloor:   70,
+		RelativeCutoff: 2,
+		LinearScaling:  DefaultLinearScalingOptions(),
+		NoteMatch:      DefaultNoteMatchOptions(),
+	}
 }
 
 func InitDatabase() *Database {
@@ -71,62 +210,164 @@ func (db *Database) AddFromFile(path string) error {
 		pitch := ParsePitch(lines[i*4+3])
 		song := MakeSong(pitch, name)
 		song.Artist = artist
-		db.AddSong(song, songId)
+		if err := db.AddSong(song, songId); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (db *Database) AddSong(song *Song, id string) {
+// AddSong adds or replaces a song. A song with empty pitch is removed
+// instead, because empty songs are not allowed in database.
+func (db *Database) AddSong(song *Song, id string) error {
 	db.Lock.Lock()
-	// I do not allow empty song in database
+	defer db.Lock.Unlock()
 	if len(song.Pitch) == 0 {
-		delete(db.Songs, id)
-	} else {
-		db.Songs[id] = song
+		if _, ok := db.Songs[id]; !ok {
+			return nil
+		}
+		return db.removeLocked(id)
 	}
-	db.Lock.Unlock()
+	if db.Journal != nil {
+		if err := db.Journal.writeAdd(id, song); err != nil {
+			return err
+		}
+	}
+	db.Songs[id] = song
+	return nil
+}
+
+// RemoveSong removes a song, or returns ErrSongNotFound
+func (db *Database) RemoveSong(id string) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	if _, ok := db.Songs[id]; !ok {
+		return ErrSongNotFound
+	}
+	return db.removeLocked(id)
+}
+
+func (db *Database) removeLocked(id string) error {
+	if db.Journal != nil {
+		if err := db.Journal.writeRemove(id); err != nil {
+			return err
+		}
+	}
+	delete(db.Songs, id)
+	return nil
+}
+
+// UpdateMetadata changes name and artist of a song, keeping its pitch
+// and ranges. It returns ErrSongNotFound for unknown id.
+func (db *Database) UpdateMetadata(id, name, artist string) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	old, ok := db.Songs[id]
+	if !ok {
+		return ErrSongNotFound
+	}
+	if db.Journal != nil {
+		if err := db.Journal.writeUpdate(id, name, artist); err != nil {
+			return err
+		}
+	}
+	// searches may still be reading the old song, so do not modify it
+	song := *old
+	song.Name = name
+	song.Artist = artist
+	db.Songs[id] = &song
+	return nil
 }
 
 func (db *Database) Search(query []PitchType) Result {
+	return db.SearchWithOptions(query, DefaultSearchOptions())
+}
+
+func (db *Database) SearchWithOptions(query []PitchType, opts SearchOptions) Result {
+	result, _ := db.SearchContext(context.Background(), query, opts)
+	return result
+}
+
+// SearchContext is SearchWithOptions that stops when ctx is done. It then
+// returns the result of songs compared so far together with ctx.Err().
+func (db *Database) SearchContext(ctx context.Context, query []PitchType, opts SearchOptions) (Result, error) {
 	q_mi := Median(query)
 
-	var d DTW_tmp
 	db.Lock.RLock()
-	songs := make([]*Song, len(db.Songs))
-	songIds := make([]string, len(db.Songs))
-	i := 0
-	for songId, song := range db.Songs {
-		songIds[i] = songId
-		songs[i] = song
-		i++
+	songIds := make([]string, 0, len(db.Songs))
+	for songId := range db.Songs {
+		songIds = append(songIds, songId)
+	}
+	// sort so that songs with equal score always come in the same order
+	sort.Strings(songIds)
+	songs := make([]*Song, len(songIds))
+	for i, songId := range songIds {
+		songs[i] = db.Songs[songId]
 	}
 	db.Lock.RUnlock()
+	origQuery := query
+	if opts.KeyInvariant {
+		query = RelativePitch(query)
+		q_mi = 0
+		for i := range songs {
+			songs[i] = songs[i].keyInvariant()
+		}
+	}
 	result := make([]SongScore, len(songs))
 	bestRans := make([]SongPitchRange, len(songs))
+	// songs whose score is a bound rather than their DTW score
+	bounded := make([]bool, len(songs))
+	for i, song := range songs {
+		// songs skipped due to cancellation look like songs without match
+		result[i] = SongScore{songIds[i], song.Name, noMatchScore, song.Artist, i, 0, nil, 0}
+	}
+
+	var stats SearchDebug
+	// indices of songs compared by DTW
+	candidates := make([]int, len(songs))
+	for i := range candidates {
+		candidates[i] = i
+	}
+	if ls := opts.LinearScaling; ls.Candidates > 0 && ls.Candidates < len(songs) {
+		lsScores := make([]PitchType, len(songs))
+		runWorkers(ctx, len(songs), &opts, func(sw *searchWorker, i int) {
+			lsScores[i], _, _ = LinearScaling(songs[i], query, &ls)
+		})
+		sort.SliceStable(candidates, func(a, b int) bool {
+			return lsScores[candidates[a]] < lsScores[candidates[b]]
+		})
+		candidates = candidates[:ls.Candidates]
+		stats.Filtered = len(songs) - ls.Candidates
+	}
+	dtwStats := runWorkers(ctx, len(candidates), &opts, func(sw *searchWorker, k int) {
+		i := candidates[k]
+		best, bestRan, exact := sw.scoreSong(ctx, songs[i], query, q_mi)
+		bestRans[i] = bestRan
+		result[i].Score = best
+		bounded[i] = !exact
+	})
+	stats.Ranges = dtwStats.Ranges
+	stats.Pruned = dtwStats.Pruned
+	stats.Abandoned = dtwStats.Abandoned
+	err := ctx.Err()
+	if opts.NoteMatch.Weight > 0 && err == nil {
+		fuseNoteScores(result, songs, origQuery, &opts.NoteMatch)
+	}
+
+	// statistics of songs with a DTW score
 	avgScore := 0.0
 	validSongs := 0
-	for i, song := range songs {
-		best := PitchType(99999.0)
-		songName := song.Name
-		for _, ran := range song.Ranges {
-			sco := d.DTW_simd(song, query, ran.From, ran.To, q_mi-ran.Median)
-			if sco < best {
-				best = sco
-				bestRans[i] = ran
-			}
-		}
-		if best < PitchType(99999.0) {
-			avgScore += float64(best)
+	for i := range result {
+		if result[i].Score < noMatchScore && !bounded[i] {
+			avgScore += float64(result[i].Score)
 			validSongs++
 		}
-		result[i] = SongScore{songIds[i], songName, best, song.Artist, i, 0}
-		i++
 	}
 	stdScore := 0.0
 	if validSongs > 1 {
 		avgScore /= float64(validSongs)
 		for i := range result {
-			if result[i].Score < PitchType(99999.0) {
+			if result[i].Score < noMatchScore && !bounded[i] {
 				diff := float64(result[i].Score) - avgScore
 				stdScore += diff * diff
 			}
@@ -134,40 +375,259 @@ func (db *Database) Search(query []PitchType) Result {
 		stdScore = stdScore / float64(validSongs)
 		stdScore = math.Sqrt(stdScore)
 	}
-	fmt.Println("Average score:", avgScore, "stdev:", stdScore)
 
-	sort.Slice(result, func(i, j int) bool {
+	sort.SliceStable(result, func(i, j int) bool {
 		return result[i].Score < result[j].Score
 	})
 	outCount := 0
 	for i := range result {
-		if i >= 100 {
+		if opts.TopK > 0 && i >= opts.TopK {
 			break
 		}
-		if float64(result[i].Score) > avgScore*0.8 && result[i].Score > PitchType(70.0) {
+		if result[i].Score >= noMatchScore {
 			break
 		}
-		if result[i].Score > result[0].Score*2 {
+		if !opts.NoFilter && opts.cutOff(result[i].Score, result[0].Score, avgScore, stdScore) {
 			break
 		}
 		outCount = i + 1
 		song := songs[result[i].From]
 		bestRan := bestRans[result[i].From]
-		_, from, to := DTW_find_where(song.Pitch[bestRan.From:bestRan.To], query, q_mi-bestRan.Median)
+		var from, to int
+		if opts.Constraint.IsZero() {
+			_, from, to = DTW_find_where(song.Pitch[bestRan.From:bestRan.To], query, q_mi-bestRan.Median)
+		} else {
+			_, from, to = DTW_find_where_constrained(song.Pitch[bestRan.From:bestRan.To], query, q_mi-bestRan.Median, opts.Constraint)
+		}
 		result[i].From = from + bestRan.From
 		result[i].To = to + bestRan.From
+		if opts.Alignment && (opts.MaxAlignments == 0 || i < opts.MaxAlignments) {
+			path := alignMatch(song.Pitch[result[i].From:result[i].To+1], query, q_mi-bestRan.Median, opts.Constraint)
+			for k := range path {
+				path[k].Song += result[i].From
+			}
+			result[i].Alignment = path
+		}
 	}
 
-	return Result{
+	out := Result{
 		Progress: "100",
-		Pitch:    query,
+		Pitch:    origQuery,
 		Songs:    result[:outCount],
 	}
+	if opts.Debug {
+		stats.Average = avgScore
+		stats.StdDev = stdScore
+		stats.Songs = len(songs)
+		stats.Matched = validSongs
+		out.Debug = &stats
+	}
+	return out, err
 	/*for rank, sco := range result[:IntMin(10, len(result))] {
 		fmt.Printf("%d. %s %f\n", rank+1, sco.Name, sco.Score)
 	}*/
 }
 
+// fuseNoteScores mixes note distance into the scores of matched songs.
+// result must still be in the order of songs.
+func fuseNoteScores(result []SongScore, songs []*Song, query []PitchType, opts *NoteMatchOptions) {
+	queryNotes := SegmentNotes(query, DefaultNoteOptions())
+	if len(queryNotes) < 2 {
+		return
+	}
+	noteScores := make([]float64, len(result))
+	avgDTW, avgNote := 0.0, 0.0
+	for i := range result {
+		if result[i].Score < noMatchScore {
+			noteScores[i] = NoteDistance(queryNotes, songs[i].Notes(), opts)
+			avgDTW += float64(result[i].Score)
+			avgNote += noteScores[i]
+		}
+	}
+	if avgNote <= 0 {
+		return
+	}
+	scale := avgDTW / avgNote
+	w := math.Min(opts.Weight, 1)
+	for i := range result {
+		if result[i].Score < noMatchScore {
+			result[i].NoteScore = PitchType(noteScores[i])
+			result[i].Score = PitchType((1-w)*float64(result[i].Score) + w*noteScores[i]*scale)
+		}
+	}
+}
+
+// runWorkers calls fn for 0 to n-1 on opts.Parallelism goroutines, until
+// ctx is done, and sums up the statistics of workers
+func runWorkers(ctx context.Context, n int, opts *SearchOptions, fn func(sw *searchWorker, i int)) SearchDebug {
+	workers := opts.Parallelism
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	var next int64 = -1
+	var wg sync.WaitGroup
+	var stats SearchDebug
+	var statsLock sync.Mutex
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sw := searchWorker{
+				opts: opts,
+				top:  topScores{k: opts.pruneTopK()},
+			}
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n || ctx.Err() != nil {
+					break
+				}
+				fn(&sw, i)
+			}
+			statsLock.Lock()
+			stats.Ranges += sw.stats.Ranges
+			stats.Pruned += sw.stats.Pruned
+			stats.Abandoned += sw.stats.Abandoned
+			statsLock.Unlock()
+		}()
+	}
+	wg.Wait()
+	return stats
+}
+
+// searchWorker holds what a search goroutine reuses between songs
+type searchWorker struct {
+	d     DTW_tmp
+	opts  *SearchOptions
+	top   topScores
+	stats SearchDebug
+	// ranges sorted by lower bound
+	order []rangeBound
+}
+
+type rangeBound struct {
+	ran   SongPitchRange
+	bound PitchType
+}
+
+// scoreSong finds the pitch range of song best matching query. If ctx is
+// done, it returns the best of ranges compared so far. exact is false if
+// pruning gives a bound instead of the DTW score.
+func (sw *searchWorker) scoreSong(ctx context.Context, song *Song, query []PitchType, q_mi PitchType) (best PitchType, bestRan SongPitchRange, exact bool) {
+	sw.stats.Ranges += len(song.Ranges)
+	if sw.opts.Prune {
+		return sw.scoreSongPruned(ctx, song, query, q_mi)
+	}
+	best = noMatchScore
+	for _, ran := range song.Ranges {
+		if ctx.Err() != nil {
+			break
+		}
+		sco := sw.dtw(song, query, ran.From, ran.To, q_mi-ran.Median)
+		if sco < best {
+			best = sco
+			bestRan = ran
+		}
+	}
+	return best, bestRan, true
+}
+
+// scoreSongPruned tries ranges from the lowest lower bound, and stops when
+// the bound cannot beat this song's best range or the k-th best song
+func (sw *searchWorker) scoreSongPruned(ctx context.Context, song *Song, query []PitchType, q_mi PitchType) (PitchType, SongPitchRange, bool) {
+	sw.order = sw.order[:0]
+	for _, ran := range song.Ranges {
+		bound := sw.d.LowerBound(song, query, ran.From, ran.To, q_mi-ran.Median)
+		sw.order = append(sw.order, rangeBound{ran, bound})
+	}
+	sort.SliceStable(sw.order, func(i, j int) bool {
+		return sw.order[i].bound < sw.order[j].bound
+	})
+	best := noMatchScore
+	var bestRan SongPitchRange
+	exact := true
+	for k, rb := range sw.order {
+		if ctx.Err() != nil {
+			break
+		}
+		limit := sw.top.limit()
+		if best < limit {
+			limit = best
+		}
+		if rb.bound > limit {
+			sw.stats.Pruned += len(sw.order) - k
+			if k == 0 {
+				// nothing compared, report the lower bound
+				best = rb.bound
+				bestRan = rb.ran
+				exact = false
+			}
+			break
+		}
+		ran := rb.ran
+		shift := q_mi - ran.Median
+		var sco PitchType
+		abandoned := false
+		if sw.opts.EarlyAbandon && sw.opts.Constraint.IsZero() {
+			// LowerBound fills d.Rest, so compute it again for this range
+			sw.d.LowerBound(song, query, ran.From, ran.To, shift)
+			sco = sw.d.DTW_early_abandon(song, query, ran.From, ran.To, shift, limit)
+			if sco > limit {
+				sw.stats.Abandoned++
+				abandoned = true
+			}
+		} else {
+			sco = sw.dtw(song, query, ran.From, ran.To, shift)
+		}
+		if sco < best {
+			best = sco
+			bestRan = ran
+			// an abandoned DTW gives only part of its score
+			exact = !abandoned
+		}
+	}
+	if best < noMatchScore {
+		sw.top.add(best)
+	}
+	return best, bestRan, exact
+}
+
+// dtw compares query with a range of song under the search constraint
+func (sw *searchWorker) dtw(song *Song, query []PitchType, from, to int, shift PitchType) PitchType {
+	if sw.opts.Constraint.IsZero() {
+		return sw.d.DTW_simd(song, query, from, to, shift)
+	}
+	return sw.d.DTW_range_constrained(song, query, from, to, shift, sw.opts.Constraint)
+}
+
+// pruneTopK returns the k of the best scores songs must beat to be
+// compared fully, 0 if every song needs its exact score
+func (opts *SearchOptions) pruneTopK() int {
+	if !opts.NoFilter && (opts.AverageCutoff > 0 || opts.StdDevCutoff > 0) {
+		return 0
+	}
+	return opts.TopK
+}
+
+// cutOff tells whether results from score on should be dropped
+func (opts *SearchOptions) cutOff(score, bestScore PitchType, avgScore, stdScore float64) bool {
+	if opts.MaxScore > 0 && score > opts.MaxScore {
+		return true
+	}
+	if opts.AverageCutoff > 0 && float64(score) > avgScore*opts.AverageCutoff && score > opts.AverageFloor {
+		return true
+	}
+	if opts.RelativeCutoff > 0 && float64(score) > float64(bestScore)*opts.RelativeCutoff {
+		return true
+	}
+	if opts.StdDevCutoff > 0 && float64(score) > avgScore-stdScore*opts.StdDevCutoff {
+		return true
+	}
+	return false
+}
+
 func MakeSong(pitch []PitchType, name string) *Song {
 	var med PitchType
 	if len(pitch) > 0 {
@@ -252,6 +712,7 @@ func MakeSong(pitch []PitchType, name string) *Song {
 		High:         hi,
 		Ranges:       ranges,
 		PitchForSimd: process_pitch,
+		derived:      newSongDerived(pitch),
 	}
 }
 
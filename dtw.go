@@ -6,6 +6,14 @@ type DTW_tmp struct {
 	Dp1   []PitchType
 	Dp2   []PitchType
 	Dp3   []PitchType
+	// used by LowerBound and DTW_early_abandon
+	Rest []PitchType
+	Row1 []PitchType
+	Row2 []PitchType
+	// used by DTW_find_where_constrained
+	Cells []dtwCell
+	// used by DTW_range_constrained
+	Lanes []PitchType
 }
 
 func (d *DTW_tmp) DTW_simd(song *Song, query []PitchType, from, to int, shift PitchType) PitchType {
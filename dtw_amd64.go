@@ -0,0 +1,45 @@
+//go:build amd64
+
+package qbsh
+
+const DTW_simd_has_impl = true
+const DTW_simd_width = 8
+
+// AVX2 processes 8 cells of an anti-diagonal at once, SSE processes 4
+var dtwHasAVX2 = cpuHasAVX2()
+
+func DTW_simd_impl(song, query []PitchType, slen, qlen int, dp1, dp2, dp3 []PitchType) PitchType {
+	if dtwHasAVX2 {
+		return dtwAVX2(song, query, slen, qlen, dp1, dp2, dp3)
+	}
+	return dtwSSE(song, query, slen, qlen, dp1, dp2, dp3)
+}
+
+func dtwAVX2(song, query []PitchType, slen, qlen int, dp1, dp2, dp3 []PitchType) PitchType
+
+func dtwSSE(song, query []PitchType, slen, qlen int, dp1, dp2, dp3 []PitchType) PitchType
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+func xgetbv() (eax, edx uint32)
+
+func cpuHasAVX2() bool {
+	maxId, _, _, _ := cpuid(0, 0)
+	if maxId < 7 {
+		return false
+	}
+	_, _, ecx1, _ := cpuid(1, 0)
+	const osxsave = 1 << 27
+	const avx = 1 << 28
+	if ecx1&osxsave == 0 || ecx1&avx == 0 {
+		return false
+	}
+	// the OS must save XMM and YMM registers
+	xcr0, _ := xgetbv()
+	if xcr0&6 != 6 {
+		return false
+	}
+	_, ebx7, _, _ := cpuid(7, 0)
+	const avx2 = 1 << 5
+	return ebx7&avx2 != 0
+}
@@ -0,0 +1,229 @@
+#include "textflag.h"
+DATA inf<>+0x00(SB)/4, $0x497423f0 // 999999.0
+GLOBL inf<>(SB), (RODATA+NOPTR), $4
+DATA absmask<>+0x00(SB)/4, $0x7fffffff
+DATA absmask<>+0x04(SB)/4, $0x7fffffff
+DATA absmask<>+0x08(SB)/4, $0x7fffffff
+DATA absmask<>+0x0c(SB)/4, $0x7fffffff
+GLOBL absmask<>(SB), (RODATA+NOPTR), $16
+
+// func dtwAVX2(song, query []PitchType, slen, qlen int, dp1, dp2, dp3 []PitchType) PitchType
+TEXT ·dtwAVX2(SB),NOSPLIT,$0-140
+	// SI = song
+	MOVQ song_base+0(FP), SI
+	// DI = query
+	MOVQ query_base+24(FP), DI
+	// R8 = slen
+	MOVQ slen+48(FP), R8
+	// R9 = qlen
+	MOVQ qlen+56(FP), R9
+	// R10 = dp1
+	MOVQ dp1_base+64(FP), R10
+	// R11 = dp2
+	MOVQ dp2_base+88(FP), R11
+	// R12 = dp3
+	MOVQ dp3_base+112(FP), R12
+
+	// both slen and qlen must > 0
+	CMPQ R8, $0
+	JLE avx2_bad
+	CMPQ R9, $0
+	JLE avx2_bad
+
+	// initialize dp table
+	// CX = i = 1
+	MOVQ $1, CX
+	// AX = inf
+	MOVL inf<>(SB), AX
+avx2_init_dp:
+	// dp1[i] = dp2[i] = dp3[i] = inf
+	MOVL AX, (R10)(CX*4)
+	MOVL AX, (R11)(CX*4)
+	MOVL AX, (R12)(CX*4)
+	INCQ CX
+	CMPQ CX, R9
+	JLE avx2_init_dp
+
+	// dp1[0] = 0
+	MOVL $0, (R10)
+
+	// X0 = ans = inf
+	VMOVSS inf<>(SB), X0
+	// Y15 = mask to clear sign bit
+	VBROADCASTSS absmask<>(SB), Y15
+	// R14 = slen+qlen
+	LEAQ (R8)(R9*1), R14
+	// R13 = &song[off] where off = slen - i, i = 0 now
+	LEAQ (SI)(R8*4), R13
+
+	// CX = i = 1
+	MOVQ $1, CX
+avx2_loop:
+	// AX = a = max(i - slen, 0)
+	MOVQ CX, AX
+	SUBQ R8, AX
+	XORQ DX, DX
+	CMPQ AX, $0
+	CMOVQLT DX, AX
+	// BX = b = min(i, qlen)
+	MOVQ CX, BX
+	CMPQ BX, R9
+	CMOVQGT R9, BX
+
+	// offset of song
+	SUBQ $4, R13
+
+avx2_innerloop:
+	// Y1 = song[off+j]
+	VMOVUPS (R13)(AX*4), Y1
+	// Y2 = query[j]
+	VMOVUPS (DI)(AX*4), Y2
+	// Y3 = v := dp2[j+1]
+	VMOVUPS 4(R11)(AX*4), Y3
+	// Y4 = v2 := dp2[j]
+	VMOVUPS (R11)(AX*4), Y4
+	// Y5 = v3 := dp1[j]
+	VMOVUPS (R10)(AX*4), Y5
+
+	// diff := song[off+j] - query[j]
+	VSUBPS Y2, Y1, Y1
+	// if diff < 0 { diff = -diff }
+	VANDPS Y15, Y1, Y1
+	// if v2 < v { v = v2 }
+	VMINPS Y4, Y3, Y3
+	// if v3 < v { v = v3 }
+	VMINPS Y5, Y3, Y3
+	// dp3[j+1] = v + diff
+	VADDPS Y1, Y3, Y3
+	VMOVUPS Y3, 4(R12)(AX*4)
+
+	// j += 8
+	ADDQ $8, AX
+	CMPQ AX, BX
+	JLT avx2_innerloop
+
+	// if dp3[qlen] < ans { ans = dp3[qlen] }
+	VMINSS (R12)(R9*4), X0, X0
+
+	// dp1, dp2, dp3 = dp2, dp3, dp1
+	MOVQ R10, AX
+	MOVQ R11, R10
+	MOVQ R12, R11
+	MOVQ AX, R12
+
+	// i++
+	INCQ CX
+	CMPQ CX, R14
+	JLT avx2_loop
+
+	VZEROUPPER
+	MOVSS X0, ret+136(FP)
+	RET
+
+avx2_bad:
+	MOVL inf<>(SB), AX
+	MOVL AX, ret+136(FP)
+	RET
+
+// func dtwSSE(song, query []PitchType, slen, qlen int, dp1, dp2, dp3 []PitchType) PitchType
+TEXT ·dtwSSE(SB),NOSPLIT,$0-140
+	MOVQ song_base+0(FP), SI
+	MOVQ query_base+24(FP), DI
+	MOVQ slen+48(FP), R8
+	MOVQ qlen+56(FP), R9
+	MOVQ dp1_base+64(FP), R10
+	MOVQ dp2_base+88(FP), R11
+	MOVQ dp3_base+112(FP), R12
+
+	CMPQ R8, $0
+	JLE sse_bad
+	CMPQ R9, $0
+	JLE sse_bad
+
+	MOVQ $1, CX
+	MOVL inf<>(SB), AX
+sse_init_dp:
+	MOVL AX, (R10)(CX*4)
+	MOVL AX, (R11)(CX*4)
+	MOVL AX, (R12)(CX*4)
+	INCQ CX
+	CMPQ CX, R9
+	JLE sse_init_dp
+
+	MOVL $0, (R10)
+
+	MOVSS inf<>(SB), X0
+	MOVUPS absmask<>(SB), X15
+	LEAQ (R8)(R9*1), R14
+	LEAQ (SI)(R8*4), R13
+
+	MOVQ $1, CX
+sse_loop:
+	MOVQ CX, AX
+	SUBQ R8, AX
+	XORQ DX, DX
+	CMPQ AX, $0
+	CMOVQLT DX, AX
+	MOVQ CX, BX
+	CMPQ BX, R9
+	CMOVQGT R9, BX
+
+	SUBQ $4, R13
+
+sse_innerloop:
+	// same as AVX2 version with 4 cells
+	MOVUPS (R13)(AX*4), X1
+	MOVUPS (DI)(AX*4), X2
+	MOVUPS 4(R11)(AX*4), X3
+	MOVUPS (R11)(AX*4), X4
+	MOVUPS (R10)(AX*4), X5
+
+	SUBPS X2, X1
+	ANDPS X15, X1
+	MINPS X4, X3
+	MINPS X5, X3
+	ADDPS X1, X3
+	MOVUPS X3, 4(R12)(AX*4)
+
+	ADDQ $4, AX
+	CMPQ AX, BX
+	JLT sse_innerloop
+
+	MINSS (R12)(R9*4), X0
+
+	MOVQ R10, AX
+	MOVQ R11, R10
+	MOVQ R12, R11
+	MOVQ AX, R12
+
+	INCQ CX
+	CMPQ CX, R14
+	JLT sse_loop
+
+	MOVSS X0, ret+136(FP)
+	RET
+
+sse_bad:
+	MOVL inf<>(SB), AX
+	MOVL AX, ret+136(FP)
+	RET
+
+// func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB),NOSPLIT,$0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax, edx uint32)
+TEXT ·xgetbv(SB),NOSPLIT,$0-8
+	MOVL $0, CX
+	// XGETBV
+	BYTE $0x0f; BYTE $0x01; BYTE $0xd0
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
@@ -0,0 +1,68 @@
+//go:build amd64
+
+package qbsh
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestDTWAmd64(t *testing.T) {
+	impls := map[string]func(song, query []PitchType, slen, qlen int, dp1, dp2, dp3 []PitchType) PitchType{
+		"sse": dtwSSE,
+	}
+	if dtwHasAVX2 {
+		impls["avx2"] = dtwAVX2
+	} else {
+		t.Log("AVX2 is not supported, testing SSE only")
+	}
+	rand.Seed(1)
+	for name, impl := range impls {
+		// reuse buffers to catch stale values from longer queries
+		var d DTW_tmp
+		for _, qlen := range []int{40, 1, 7, 8, 9, 17, 3} {
+			for _, slen := range []int{1, 5, 8, 33, 100} {
+				query := RandPitch(qlen)
+				song := MakeSong(RandPitch(slen), "name")
+				d.DTW_simd(song, query, 0, slen, 2)
+				nSong := len(song.Pitch)
+				ans := impl(song.PitchForSimd[nSong-slen:nSong], d.Query, slen, qlen, d.Dp1, d.Dp2, d.Dp3)
+				if want := DTW(song.Pitch, query, 2); ans != want {
+					t.Errorf("%s query %d song %d gives %v, want %v", name, qlen, slen, ans, want)
+				}
+			}
+		}
+	}
+}
+
+func TestConstrainedDTWAmd64(t *testing.T) {
+	impls := []bool{false}
+	if dtwHasAVX2 {
+		impls = append(impls, true)
+	}
+	defer func(has bool) { dtwHasAVX2 = has }(dtwHasAVX2)
+	rand.Seed(2)
+	for _, avx2 := range impls {
+		dtwHasAVX2 = avx2
+		var d DTW_tmp
+		for _, qlen := range []int{40, 1, 7, 8, 9, 17, 3} {
+			for _, slen := range []int{1, 5, 8, 33, 100} {
+				query := RandPitch(qlen)
+				song := MakeSong(RandPitch(slen), "name")
+				for band := 0; band <= 12; band++ {
+					for _, slope := range []bool{false, true} {
+						c := DTWConstraint{Band: band, LimitSlope: slope}
+						if c.IsZero() {
+							continue
+						}
+						from := slen / 3
+						ans := d.DTW_range_constrained(song, query, from, slen, 2, c)
+						if want := DTW_constrained(song.Pitch[from:], query, 2, c); ans != want {
+							t.Errorf("avx2 %v query %d song %d %+v gives %v, want %v", avx2, qlen, slen, c, ans, want)
+						}
+					}
+				}
+			}
+		}
+	}
+}
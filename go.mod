@@ -1,6 +1,6 @@
 module github.com/stdio2016/qbsh
 
-go 1.17
+go 1.19
 
 require github.com/unixpickle/wav v0.0.0-20190525173943-42cf4c455f64
 
@@ -0,0 +1,234 @@
+package qbsh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// journal record layout, all integers are little endian: payload length
+// uint32, crc32 (IEEE) of payload uint32, crc32 of the first 8 bytes
+// uint32, then payload. the first byte of payload is the operation
+const (
+	journalAdd    byte = 1
+	journalRemove byte = 2
+	journalUpdate byte = 3
+)
+
+var ErrBadJournal = errors.New("invalid qbsh journal")
+
+// Journal is an append-only log of changes made to a Database after it
+// was loaded, so that songs added at runtime survive a restart
+type Journal struct {
+	file *os.File
+	size int64
+	lock sync.Mutex
+}
+
+// AttachJournal replays the journal at path into db, then makes every
+// later change to db append to it. A record cut short by a crash is
+// dropped from the end of the file. A broken record before the last one,
+// or a broken record header anywhere, is an ErrBadJournal and leaves the
+// file as it is. It returns the number
+// of records replayed.
+func (db *Database) AttachJournal(path string) (int, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	count, valid, err := db.replayJournal(bufio.NewReader(f), info.Size())
+	if err == nil {
+		err = f.Truncate(valid)
+	}
+	if err == nil {
+		_, err = f.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return count, err
+	}
+	db.Lock.Lock()
+	db.Journal = &Journal{file: f, size: valid}
+	db.Lock.Unlock()
+	return count, nil
+}
+
+// replayJournal applies records until the end of r or a torn last
+// record, and returns how many bytes were valid
+func (db *Database) replayJournal(r io.Reader, total int64) (int, int64, error) {
+	var valid int64
+	count := 0
+	var header [12]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return count, valid, nil
+			}
+			return count, valid, err
+		}
+		size := binary.LittleEndian.Uint32(header[:4])
+		sum := binary.LittleEndian.Uint32(header[4:8])
+		if crc32.ChecksumIEEE(header[:8]) != binary.LittleEndian.Uint32(header[8:]) {
+			// the length cannot be trusted, so there is no telling
+			// whether this is the last record
+			return count, valid, fmt.Errorf("%w: header checksum mismatch at byte %d", ErrBadJournal, valid)
+		}
+		if int64(size) > total-valid-int64(len(header)) {
+			return count, valid, nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return count, valid, nil
+			}
+			return count, valid, err
+		}
+		end := valid + int64(len(header)) + int64(size)
+		if size == 0 || crc32.ChecksumIEEE(payload) != sum {
+			// a crash can leave garbage only in the last record
+			if end == total {
+				return count, valid, nil
+			}
+			return count, valid, fmt.Errorf("%w: checksum mismatch at byte %d", ErrBadJournal, valid)
+		}
+		if err := db.applyRecord(payload); err != nil {
+			return count, valid, fmt.Errorf("%w: record at byte %d: %v", ErrBadJournal, valid, err)
+		}
+		valid = end
+		count++
+	}
+}
+
+func (db *Database) applyRecord(payload []byte) error {
+	dec := songDecoder{data: payload[1:]}
+	switch payload[0] {
+	case journalAdd:
+		id, song := dec.song()
+		if dec.err != nil {
+			return dec.err
+		}
+		db.Lock.Lock()
+		db.Songs[id] = song
+		db.Lock.Unlock()
+	case journalRemove:
+		id := dec.string()
+		if dec.err != nil {
+			return dec.err
+		}
+		db.Lock.Lock()
+		delete(db.Songs, id)
+		db.Lock.Unlock()
+	case journalUpdate:
+		id := dec.string()
+		name := dec.string()
+		artist := dec.string()
+		if dec.err != nil {
+			return dec.err
+		}
+		db.Lock.Lock()
+		if old, ok := db.Songs[id]; ok {
+			song := *old
+			song.Name = name
+			song.Artist = artist
+			db.Songs[id] = &song
+		}
+		db.Lock.Unlock()
+	default:
+		return fmt.Errorf("unknown operation %d", payload[0])
+	}
+	return nil
+}
+
+func (j *Journal) write(payload []byte) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	var header [12]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	binary.LittleEndian.PutUint32(header[8:], crc32.ChecksumIEEE(header[:8]))
+	_, err := j.file.Write(append(header[:], payload...))
+	if err == nil {
+		err = j.file.Sync()
+	}
+	if err != nil {
+		// drop the partial record so later records stay readable
+		j.file.Truncate(j.size)
+		j.file.Seek(j.size, io.SeekStart)
+		return err
+	}
+	j.size += int64(len(header) + len(payload))
+	return nil
+}
+
+func (j *Journal) writeAdd(id string, song *Song) error {
+	var buf bytes.Buffer
+	buf.WriteByte(journalAdd)
+	encodeSong(&buf, id, song)
+	return j.write(buf.Bytes())
+}
+
+func (j *Journal) writeRemove(id string) error {
+	var buf bytes.Buffer
+	buf.WriteByte(journalRemove)
+	writeString(&buf, id)
+	return j.write(buf.Bytes())
+}
+
+func (j *Journal) writeUpdate(id, name, artist string) error {
+	var buf bytes.Buffer
+	buf.WriteByte(journalUpdate)
+	writeString(&buf, id)
+	writeString(&buf, name)
+	writeString(&buf, artist)
+	return j.write(buf.Bytes())
+}
+
+// Size returns the journal length in bytes
+func (j *Journal) Size() int64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.size
+}
+
+func (j *Journal) truncate() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := j.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	j.size = 0
+	return j.file.Sync()
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// Compact writes the whole database to the snapshot at path and empties
+// the journal. Changes are blocked while compacting. If the process
+// dies between the two steps, replaying the journal again is harmless.
+func (db *Database) Compact(path string) error {
+	db.Lock.Lock()
+	defer db.Lock.Unlock()
+	if err := db.saveSnapshotFileLocked(path); err != nil {
+		return err
+	}
+	if db.Journal != nil {
+		return db.Journal.truncate()
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package qbsh
+
+// KeyWindow is the number of frames averaged by RelativePitch, about 4
+// seconds of song
+const KeyWindow = 64
+
+// RelativePitch subtracts from each frame the mean pitch of the KeyWindow
+// frames around it, so transposing pitch by any amount, even a fraction
+// of semitone, gives the same result
+func RelativePitch(pitch []PitchType) []PitchType {
+	cumsums := make([]float64, len(pitch)+1)
+	for i, p := range pitch {
+		cumsums[i+1] = cumsums[i] + float64(p)
+	}
+	out := make([]PitchType, len(pitch))
+	for i := range pitch {
+		from := IntMax(i-KeyWindow/2, 0)
+		to := IntMin(i+KeyWindow/2, len(pitch))
+		mean := (cumsums[to] - cumsums[from]) / float64(to-from)
+		out[i] = pitch[i] - PitchType(mean)
+	}
+	return out
+}
+
+// keyInvariant returns song with pitch replaced by its relative pitch and
+// a single range over the whole song, if the song has any range
+func (song *Song) keyInvariant() *Song {
+	view := *song
+	view.Pitch, view.PitchForSimd = song.relative()
+	view.Median = 0
+	view.Low = 0
+	view.High = 0
+	view.Ranges = nil
+	if len(song.Ranges) > 0 {
+		view.Ranges = []SongPitchRange{{0, len(view.Pitch), 0}}
+	}
+	return &view
+}
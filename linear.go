@@ -0,0 +1,129 @@
+package qbsh
+
+import (
+	"math"
+	"sort"
+)
+
+// LinearScalingOptions configures linear scaling, which stretches the
+// whole query by a few fixed factors and compares it point to point with
+// the song. It is much cheaper than DTW, but cannot follow tempo changes
+// inside the query.
+type LinearScalingOptions struct {
+	// number of songs with the best linear scaling distance that are
+	// compared by DTW, 0 compares all songs
+	Candidates int
+	// lengths tried for the query, relative to its own length
+	Scales []float64
+	// semitones added to the key found from mean pitch
+	KeyShifts []PitchType
+	// the query is resampled to this many points
+	Points int
+	// song frames between tried start positions, 0 means the distance
+	// between points of the scaled query
+	Hop int
+}
+
+// DefaultLinearScalingOptions allows tempo from half to twice the query.
+// Candidates is 0, so search does not use linear scaling by default.
+func DefaultLinearScalingOptions() LinearScalingOptions {
+	return LinearScalingOptions{
+		Scales:    []float64{0.5, 0.625, 0.75, 0.875, 1, 1.25, 1.5, 1.75, 2},
+		KeyShifts: []PitchType{0},
+		Points:    16,
+	}
+}
+
+// LinearScaling returns the smallest mean absolute pitch difference
+// between the scaled query and any part of song covered by its pitch
+// ranges, and the song frames from and to of that part. The key of each
+// part is matched by its mean pitch, plus each of KeyShifts. It returns
+// noMatchScore if the query does not fit in any range.
+func LinearScaling(song *Song, query []PitchType, opts *LinearScalingOptions) (PitchType, int, int) {
+	best := noMatchScore
+	bestFrom, bestTo := 0, 0
+	points := opts.Points
+	if points <= 0 || points > len(query) {
+		points = len(query)
+	}
+	if points == 0 {
+		return best, bestFrom, bestTo
+	}
+	keyShifts := opts.KeyShifts
+	if len(keyShifts) == 0 {
+		keyShifts = []PitchType{0}
+	}
+	sampled := make([]PitchType, points)
+	var qMean PitchType
+	for k := range sampled {
+		sampled[k] = query[k*len(query)/points]
+		qMean += sampled[k]
+	}
+	qMean /= PitchType(points)
+
+	// ranges of different keys overlap, so scan their union only once
+	spans := make([]SongPitchRange, len(song.Ranges))
+	copy(spans, song.Ranges)
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].From < spans[j].From
+	})
+	merged := spans[:0]
+	for _, ran := range spans {
+		if n := len(merged); n > 0 && ran.From <= merged[n-1].To {
+			if ran.To > merged[n-1].To {
+				merged[n-1].To = ran.To
+			}
+			continue
+		}
+		merged = append(merged, ran)
+	}
+
+	// mean pitch of a part is a difference of prefix sums
+	cumsums := make([]float64, len(song.Pitch)+1)
+	for i, p := range song.Pitch {
+		cumsums[i+1] = cumsums[i] + float64(p)
+	}
+
+	offsets := make([]int, points)
+	for _, scale := range opts.Scales {
+		length := int(math.Round(float64(len(query)) * scale))
+		if length < 1 {
+			continue
+		}
+		for k := range offsets {
+			offsets[k] = k * length / points
+		}
+		hop := opts.Hop
+		if hop <= 0 {
+			hop = IntMax(length/points, 1)
+		}
+		for _, ran := range merged {
+			for start := ran.From; start+length <= ran.To; start += hop {
+				sMean := PitchType((cumsums[start+length] - cumsums[start]) / float64(length))
+				for _, key := range keyShifts {
+					// compare song + shift with query, and stop once the
+					// sum cannot beat the best part
+					shift := qMean - sMean + key
+					limit := best * PitchType(points)
+					var sum PitchType
+					for k, off := range offsets {
+						diff := song.Pitch[start+off] + shift - sampled[k]
+						if diff < 0 {
+							diff = -diff
+						}
+						sum += diff
+						if sum >= limit {
+							break
+						}
+					}
+					sco := sum / PitchType(points)
+					if sco < best {
+						best = sco
+						bestFrom, bestTo = start, start+length-1
+					}
+				}
+			}
+		}
+	}
+	return best, bestFrom, bestTo
+}
@@ -0,0 +1,484 @@
+package qbsh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PitchFrameRate is the number of pitch frames per second of songs
+// rendered from MIDI files. Pitch tracked from recordings is converted to
+// it with ToPitchFrameRate
+const PitchFrameRate = 16
+
+// MIDI channel 10 is reserved for percussion
+const midiDrumChannel = 9
+
+var ErrBadMIDI = errors.New("invalid MIDI file")
+var ErrNoMelody = errors.New("no melody found in MIDI file")
+
+type MidiNote struct {
+	Channel  int
+	Key      int
+	Velocity int
+	// in seconds
+	Start float64
+	End   float64
+}
+
+type MidiTrack struct {
+	Name  string
+	Notes []MidiNote
+}
+
+type MidiFile struct {
+	Format   int
+	Division int
+	Tracks   []MidiTrack
+}
+
+type midiEvent struct {
+	tick   int64
+	status byte
+	data   []byte
+	// type of meta event
+	meta byte
+}
+
+type midiTempo struct {
+	tick int64
+	// microseconds per quarter note
+	tempo int64
+}
+
+func ReadMIDIFile(path string) (*MidiFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseMIDI(bufio.NewReader(f))
+}
+
+// ParseMIDI reads a Standard MIDI File and converts note on/off events
+// into notes timed in seconds
+func ParseMIDI(r io.Reader) (*MidiFile, error) {
+	var header [14]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadMIDI, err)
+	}
+	if string(header[:4]) != "MThd" || binary.BigEndian.Uint32(header[4:8]) < 6 {
+		return nil, fmt.Errorf("%w: missing MThd header", ErrBadMIDI)
+	}
+	// skip extra header bytes
+	if _, err := io.CopyN(io.Discard, r, int64(binary.BigEndian.Uint32(header[4:8]))-6); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadMIDI, err)
+	}
+	m := &MidiFile{
+		Format:   int(binary.BigEndian.Uint16(header[8:10])),
+		Division: int(binary.BigEndian.Uint16(header[12:14])),
+	}
+	nTracks := int(binary.BigEndian.Uint16(header[10:12]))
+	if m.Division == 0 {
+		return nil, fmt.Errorf("%w: division is 0", ErrBadMIDI)
+	}
+
+	var trackEvents [][]midiEvent
+	var tempos []midiTempo
+	for len(trackEvents) < nTracks {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadMIDI, err)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(chunk[4:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadMIDI, err)
+		}
+		if string(chunk[:4]) != "MTrk" {
+			// unknown chunks must be ignored
+			continue
+		}
+		events, err := parseMidiTrack(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: track %d: %v", ErrBadMIDI, len(trackEvents), err)
+		}
+		for _, ev := range events {
+			if ev.status == 0xFF && ev.meta == 0x51 && len(ev.data) == 3 {
+				tempo := int64(ev.data[0])<<16 | int64(ev.data[1])<<8 | int64(ev.data[2])
+				tempos = append(tempos, midiTempo{ev.tick, tempo})
+			}
+		}
+		trackEvents = append(trackEvents, events)
+	}
+
+	// tempo changes in any track apply to all tracks
+	sort.SliceStable(tempos, func(i, j int) bool {
+		return tempos[i].tick < tempos[j].tick
+	})
+	toSeconds := m.tickConverter(tempos)
+	for _, events := range trackEvents {
+		m.Tracks = append(m.Tracks, makeMidiTrack(events, toSeconds))
+	}
+	return m, nil
+}
+
+func readVLQ(data []byte, pos int) (int64, int, error) {
+	var n int64
+	for i := 0; i < 4; i++ {
+		if pos >= len(data) {
+			return 0, pos, io.ErrUnexpectedEOF
+		}
+		b := data[pos]
+		pos++
+		n = n<<7 | int64(b&0x7F)
+		if b&0x80 == 0 {
+			return n, pos, nil
+		}
+	}
+	return 0, pos, errors.New("variable length quantity too long")
+}
+
+func parseMidiTrack(data []byte) ([]midiEvent, error) {
+	var events []midiEvent
+	var tick int64
+	var running byte
+	pos := 0
+	for pos < len(data) {
+		delta, p, err := readVLQ(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		pos = p
+		tick += delta
+		if pos >= len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		status := data[pos]
+		if status < 0x80 {
+			if running == 0 {
+				return nil, errors.New("data byte without status")
+			}
+			status = running
+		} else {
+			pos++
+		}
+		ev := midiEvent{tick: tick, status: status}
+		switch {
+		case status == 0xFF:
+			if pos >= len(data) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			ev.meta = data[pos]
+			length, p, err := readVLQ(data, pos+1)
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(data)-p) < length {
+				return nil, io.ErrUnexpectedEOF
+			}
+			ev.data = data[p : p+int(length)]
+			pos = p + int(length)
+			running = 0
+		case status == 0xF0 || status == 0xF7:
+			length, p, err := readVLQ(data, pos)
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(data)-p) < length {
+				return nil, io.ErrUnexpectedEOF
+			}
+			pos = p + int(length)
+			running = 0
+		case status >= 0xF0:
+			return nil, fmt.Errorf("unexpected status %#x", status)
+		default:
+			size := 2
+			if status&0xF0 == 0xC0 || status&0xF0 == 0xD0 {
+				size = 1
+			}
+			if pos+size > len(data) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			ev.data = data[pos : pos+size]
+			pos += size
+			running = status
+		}
+		events = append(events, ev)
+		if status == 0xFF && ev.meta == 0x2F {
+			// end of track
+			break
+		}
+	}
+	return events, nil
+}
+
+func (m *MidiFile) tickConverter(tempos []midiTempo) func(int64) float64 {
+	if m.Division&0x8000 != 0 {
+		// SMPTE time: frames per second and ticks per frame
+		fps := float64(-int8(m.Division >> 8))
+		if fps == 29 {
+			fps = 29.97
+		}
+		ticksPerSecond := fps * float64(m.Division&0xFF)
+		return func(tick int64) float64 {
+			return float64(tick) / ticksPerSecond
+		}
+	}
+	ppq := float64(m.Division)
+	// seconds at each tempo change
+	seconds := make([]float64, len(tempos))
+	prevTick := int64(0)
+	prevTempo := int64(500000)
+	elapsed := 0.0
+	for i, t := range tempos {
+		elapsed += float64(t.tick-prevTick) * float64(prevTempo) / ppq / 1e6
+		seconds[i] = elapsed
+		prevTick, prevTempo = t.tick, t.tempo
+	}
+	return func(tick int64) float64 {
+		i := sort.Search(len(tempos), func(i int) bool {
+			return tempos[i].tick > tick
+		})
+		if i == 0 {
+			return float64(tick) * 500000 / ppq / 1e6
+		}
+		t := tempos[i-1]
+		return seconds[i-1] + float64(tick-t.tick)*float64(t.tempo)/ppq/1e6
+	}
+}
+
+func makeMidiTrack(events []midiEvent, toSeconds func(int64) float64) MidiTrack {
+	var track MidiTrack
+	// index+1 of the sounding note in track.Notes for each channel and key
+	var sounding [16][128]int
+	lastTick := int64(0)
+	for _, ev := range events {
+		lastTick = ev.tick
+		if ev.status == 0xFF {
+			if ev.meta == 0x03 && track.Name == "" {
+				track.Name = string(ev.data)
+			}
+			continue
+		}
+		kind := ev.status & 0xF0
+		if kind != 0x80 && kind != 0x90 {
+			continue
+		}
+		channel := int(ev.status & 0x0F)
+		key := int(ev.data[0] & 0x7F)
+		velocity := int(ev.data[1] & 0x7F)
+		now := toSeconds(ev.tick)
+		if idx := sounding[channel][key]; idx > 0 {
+			track.Notes[idx-1].End = now
+			sounding[channel][key] = 0
+		}
+		if kind == 0x90 && velocity > 0 {
+			track.Notes = append(track.Notes, MidiNote{
+				Channel:  channel,
+				Key:      key,
+				Velocity: velocity,
+				Start:    now,
+			})
+			sounding[channel][key] = len(track.Notes)
+		}
+	}
+	// notes never turned off end with the track
+	end := toSeconds(lastTick)
+	for channel := range sounding {
+		for _, idx := range sounding[channel] {
+			if idx > 0 {
+				track.Notes[idx-1].End = end
+			}
+		}
+	}
+	// drop notes of zero length
+	notes := track.Notes[:0]
+	for _, note := range track.Notes {
+		if note.End > note.Start {
+			notes = append(notes, note)
+		}
+	}
+	track.Notes = notes
+	return track
+}
+
+// polyphony returns the fraction of note time overlapped by another note
+func (t *MidiTrack) polyphony() float64 {
+	total := 0.0
+	overlap := 0.0
+	maxEnd := 0.0
+	for i, note := range t.Notes {
+		total += note.End - note.Start
+		if i > 0 && maxEnd > note.Start {
+			overlap += minFloat(maxEnd, note.End) - note.Start
+		}
+		if note.End > maxEnd {
+			maxEnd = note.End
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return overlap / total
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// MelodyTrack guesses which track has the melody: the one with most
+// notes among nearly monophonic tracks, ignoring percussion. If every
+// track has chords, the least polyphonic one is used.
+// It returns -1 if no track has notes.
+func (m *MidiFile) MelodyTrack() int {
+	best := -1
+	bestPoly := 0.0
+	bestNotes := 0
+	for i := range m.Tracks {
+		track := &m.Tracks[i]
+		notes := 0
+		for _, note := range track.Notes {
+			if note.Channel != midiDrumChannel {
+				notes++
+			}
+		}
+		if notes == 0 {
+			continue
+		}
+		poly := track.polyphony()
+		// overlaps under 10% are usually legato
+		if poly < 0.1 {
+			poly = 0
+		}
+		if best == -1 || poly < bestPoly || (poly == bestPoly && notes > bestNotes) {
+			best = i
+			bestPoly = poly
+			bestNotes = notes
+		}
+	}
+	return best
+}
+
+// MidiNotesToPitch renders notes into PitchFrameRate frames per second.
+// When notes overlap, the latest started note is used. Rests keep the
+// previous pitch like FixPitch does, and silence at both ends is removed.
+func MidiNotesToPitch(notes []MidiNote) []PitchType {
+	sorted := make([]MidiNote, 0, len(notes))
+	for _, note := range notes {
+		if note.Channel != midiDrumChannel {
+			sorted = append(sorted, note)
+		}
+	}
+	if len(sorted) == 0 {
+		return nil
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	begin := sorted[0].Start
+	end := 0.0
+	for _, note := range sorted {
+		if note.End > end {
+			end = note.End
+		}
+	}
+	nFrames := int((end - begin) * PitchFrameRate)
+	out := make([]PitchType, 0, nFrames)
+	pitch := PitchType(sorted[0].Key)
+	next := 0
+	var active []MidiNote
+	for f := 0; f < nFrames; f++ {
+		t := begin + (float64(f)+0.5)/PitchFrameRate
+		for next < len(sorted) && sorted[next].Start <= t {
+			active = append(active, sorted[next])
+			next++
+		}
+		// remove ended notes
+		alive := active[:0]
+		for _, note := range active {
+			if note.End > t {
+				alive = append(alive, note)
+			}
+		}
+		active = alive
+		if len(active) > 0 {
+			pitch = PitchType(active[len(active)-1].Key)
+		}
+		out = append(out, pitch)
+	}
+	return out
+}
+
+// MidiImport records how a MIDI file was added
+type MidiImport struct {
+	File       string
+	SongId     string
+	Track      int
+	Channel    int
+	Polyphonic bool
+}
+
+// ReadMIDIMelody extracts the melody of one track of a MIDI file, or of
+// the guessed melody track if track is negative
+func ReadMIDIMelody(path string, track int, opts SkylineOptions) (MidiMelody, error) {
+	m, err := ReadMIDIFile(path)
+	if err != nil {
+		return MidiMelody{}, err
+	}
+	return m.ExtractMelody(track, opts)
+}
+
+// AddFromMIDI adds the melody of a MIDI file as a song. A negative track
+// means the melody track is guessed.
+func (db *Database) AddFromMIDI(path string, id, name, artist string, track int) (MidiMelody, error) {
+	melody, err := ReadMIDIMelody(path, track, DefaultSkylineOptions())
+	if err != nil {
+		return melody, err
+	}
+	song := MakeSong(MidiNotesToPitch(melody.Notes), name)
+	song.Artist = artist
+	return melody, db.AddSong(song, id)
+}
+
+// AddFromMIDIDir adds every .mid file in dir, using the file name without
+// extension as song id and name. Files that fail are skipped and the
+// first error is returned after trying all files.
+func (db *Database) AddFromMIDIDir(dir string) ([]MidiImport, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var imports []MidiImport
+	var firstErr error
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".mid" && ext != ".midi") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		melody, err := db.AddFromMIDI(filepath.Join(dir, entry.Name()), id, id, "", -1)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", entry.Name(), err)
+			}
+			continue
+		}
+		imports = append(imports, MidiImport{
+			File:       entry.Name(),
+			SongId:     id,
+			Track:      melody.Track,
+			Channel:    melody.Channel,
+			Polyphonic: melody.Polyphonic,
+		})
+	}
+	return imports, firstErr
+}
@@ -0,0 +1,89 @@
+package qbsh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// makeTestMIDI builds a format 1 file with 96 ticks per quarter note.
+// Each track is raw event bytes without the end of track event.
+func makeTestMIDI(tracks ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("MThd")
+	binary.Write(&buf, binary.BigEndian, []uint32{6})
+	binary.Write(&buf, binary.BigEndian, []uint16{1, uint16(len(tracks)), 96})
+	for _, track := range tracks {
+		track = append(track, 0, 0xFF, 0x2F, 0)
+		buf.WriteString("MTrk")
+		binary.Write(&buf, binary.BigEndian, uint32(len(track)))
+		buf.Write(track)
+	}
+	return buf.Bytes()
+}
+
+func TestParseMIDI(t *testing.T) {
+	// tempo 1 second per quarter note
+	tempo := []byte{0, 0xFF, 0x51, 3, 0x0F, 0x42, 0x40}
+	// 4 quarter notes using running status and note on with velocity 0
+	melody := []byte{
+		0, 0xFF, 0x03, 3, 'v', 'o', 'x',
+		0, 0x90, 60, 100, 0x60, 60, 0,
+		0, 62, 100, 0x60, 62, 0,
+		0, 64, 100, 0x60, 0x80, 64, 0,
+		0, 0x90, 65, 100, 0x60, 65, 0,
+	}
+	// 2 chords
+	chords := []byte{
+		0, 0x91, 48, 80, 0, 52, 80, 0, 55, 80,
+		0x81, 0x40, 48, 0, 0, 52, 0, 0, 55, 0,
+		0, 50, 80, 0, 53, 80,
+		0x81, 0x40, 50, 0, 0, 53, 0,
+	}
+	m, err := ParseMIDI(bytes.NewReader(makeTestMIDI(tempo, chords, melody)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tracks) != 3 || len(m.Tracks[2].Notes) != 4 || m.Tracks[2].Name != "vox" {
+		t.Fatalf("wrong tracks %v", m.Tracks)
+	}
+	if note := m.Tracks[2].Notes[1]; note.Key != 62 || note.Start != 1 || note.End != 2 {
+		t.Errorf("wrong note %v", note)
+	}
+	if track := m.MelodyTrack(); track != 2 {
+		t.Errorf("melody track is %d", track)
+	}
+	pitch := MidiNotesToPitch(m.Tracks[2].Notes)
+	if len(pitch) != 4*PitchFrameRate || pitch[0] != 60 || pitch[len(pitch)-1] != 65 {
+		t.Errorf("wrong pitch %v", pitch)
+	}
+
+	if _, err := ParseMIDI(bytes.NewReader([]byte("MThd"))); err == nil {
+		t.Error("truncated file should fail")
+	}
+}
+
+func TestSkyline(t *testing.T) {
+	notes := []MidiNote{
+		{Channel: 1, Key: 48, Start: 0, End: 2},
+		{Channel: 1, Key: 52, Start: 0, End: 1},
+		{Channel: 1, Key: 55, Start: 0.5, End: 1},
+		// too short
+		{Channel: 1, Key: 70, Start: 1.5, End: 1.51},
+		// drum
+		{Channel: 9, Key: 80, Start: 0, End: 3},
+		// after a short rest
+		{Channel: 2, Key: 50, Start: 2.1, End: 3},
+	}
+	got := Skyline(notes, DefaultSkylineOptions())
+	want := []MidiNote{
+		{Channel: 1, Key: 52, Start: 0, End: 0.5},
+		{Channel: 1, Key: 55, Start: 0.5, End: 1},
+		{Channel: 1, Key: 48, Start: 1, End: 2.1},
+		{Channel: 2, Key: 50, Start: 2.1, End: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("skyline gives %v", got)
+	}
+}
@@ -0,0 +1,87 @@
+package qbsh
+
+import "math"
+
+// NoteMatchOptions configures the note matcher, which compares the
+// intervals and duration ratios between successive notes. It does not
+// care about key or tempo, and a wrong rhythm costs less than in DTW.
+type NoteMatchOptions struct {
+	// weight of the note distance in the search score, from 0 to 1.
+	// 0 disables note matching
+	Weight float64
+	// cost of a hummed interval missing in the song
+	InsertCost float64
+	// cost of a song interval not hummed
+	DeleteCost float64
+	// substitution costs IntervalWeight per semitone of interval error
+	// plus DurationWeight per octave of duration ratio error
+	IntervalWeight float64
+	DurationWeight float64
+}
+
+// DefaultNoteMatchOptions leaves note matching off in search
+func DefaultNoteMatchOptions() NoteMatchOptions {
+	return NoteMatchOptions{
+		InsertCost:     1,
+		DeleteCost:     1,
+		IntervalWeight: 0.5,
+		DurationWeight: 0.5,
+	}
+}
+
+// noteStep is the move from a note to the next one
+type noteStep struct {
+	interval PitchType
+	// log2 of duration ratio
+	ratio float64
+}
+
+func noteSteps(notes []Note) []noteStep {
+	if len(notes) < 2 {
+		return nil
+	}
+	steps := make([]noteStep, len(notes)-1)
+	for k := range steps {
+		a, b := notes[k], notes[k+1]
+		steps[k].interval = b.Pitch - a.Pitch
+		steps[k].ratio = math.Log2(float64(b.Duration) / float64(a.Duration))
+	}
+	return steps
+}
+
+// NoteDistance is the weighted edit distance between the note steps of
+// query and the best matching part of song, divided by the number of query
+// steps. It returns 0 if query has less than 2 notes.
+func NoteDistance(query, song []Note, opts *NoteMatchOptions) float64 {
+	q := noteSteps(query)
+	s := noteSteps(song)
+	if len(q) == 0 {
+		return 0
+	}
+	// dp over song steps, the match may start and end anywhere in song
+	dp1 := make([]float64, len(s)+1)
+	dp2 := make([]float64, len(s)+1)
+	for i := range q {
+		dp2[0] = dp1[0] + opts.InsertCost
+		for j := range s {
+			interval := float64(q[i].interval - s[j].interval)
+			sub := opts.IntervalWeight*math.Abs(interval) + opts.DurationWeight*math.Abs(q[i].ratio-s[j].ratio)
+			v := dp1[j] + sub
+			if ins := dp1[j+1] + opts.InsertCost; ins < v {
+				v = ins
+			}
+			if del := dp2[j] + opts.DeleteCost; del < v {
+				v = del
+			}
+			dp2[j+1] = v
+		}
+		dp1, dp2 = dp2, dp1
+	}
+	best := dp1[0]
+	for _, v := range dp1 {
+		if v < best {
+			best = v
+		}
+	}
+	return best / float64(len(q))
+}
@@ -0,0 +1,145 @@
+package qbsh
+
+// Note is a sung note found in a pitch contour. Start and Duration are in
+// frames of the contour.
+type Note struct {
+	Pitch    PitchType `json:"pitch"`
+	Start    int       `json:"start"`
+	Duration int       `json:"duration"`
+}
+
+// End is the frame after the note
+func (n Note) End() int {
+	return n.Start + n.Duration
+}
+
+type NoteOptions struct {
+	// a note ends when pitch moves more than this many semitones away from
+	// the median pitch of the note, and stays away for MinDuration frames
+	OnsetThreshold PitchType
+	// notes shorter than this are merged into the neighbouring note with
+	// closer pitch, or dropped if they have no neighbour. This absorbs
+	// glides between notes and vibrato
+	MinDuration int
+}
+
+// DefaultNoteOptions suits GetWavPitch2 output at 20 frames per second
+func DefaultNoteOptions() NoteOptions {
+	return NoteOptions{
+		OnsetThreshold: 0.7,
+		MinDuration:    3,
+	}
+}
+
+// SegmentNotes groups frames of pitch into notes. Frames with pitch -1
+// are unvoiced and separate notes.
+func SegmentNotes(pitch []PitchType, opts NoteOptions) []Note {
+	minDur := opts.MinDuration
+	if minDur < 1 {
+		minDur = 1
+	}
+	var notes []Note
+	for i := 0; i < len(pitch); {
+		if pitch[i] == -1 {
+			i++
+			continue
+		}
+		// voiced run is pitch[i:end]
+		end := i
+		for end < len(pitch) && pitch[end] != -1 {
+			end++
+		}
+		notes = append(notes, segmentRun(pitch, i, end, minDur, opts.OnsetThreshold)...)
+		i = end
+	}
+	return notes
+}
+
+// segmentRun segments the voiced frames pitch[from:to]
+func segmentRun(pitch []PitchType, from, to, minDur int, threshold PitchType) []Note {
+	var notes []Note
+	cur := Note{Pitch: pitch[from], Start: from, Duration: 1}
+	for i := from + 1; i < to; i++ {
+		diff := pitch[i] - cur.Pitch
+		if diff > threshold || diff < -threshold {
+			// vibrato and short glitches do not start a note
+			confirm := IntMin(i+minDur, to)
+			next := Median(pitch[i:confirm])
+			diff = next - cur.Pitch
+			if confirm-i == minDur && (diff > threshold || diff < -threshold) {
+				notes = append(notes, cur)
+				cur = Note{Pitch: pitch[i], Start: i, Duration: 1}
+				continue
+			}
+		}
+		cur.Duration++
+		cur.Pitch = Median(pitch[cur.Start:cur.End()])
+	}
+	notes = append(notes, cur)
+
+	// merge short notes, shortest first, so a glide joins the note it
+	// leads to
+	for len(notes) > 0 {
+		k := -1
+		for n := range notes {
+			if notes[n].Duration < minDur && (k < 0 || notes[n].Duration < notes[k].Duration) {
+				k = n
+			}
+		}
+		if k < 0 {
+			break
+		}
+		if len(notes) == 1 {
+			return nil
+		}
+		into := k - 1
+		if k == 0 {
+			into = 1
+		} else if k+1 < len(notes) {
+			left := notes[k].Pitch - notes[k-1].Pitch
+			right := notes[k].Pitch - notes[k+1].Pitch
+			if left < 0 {
+				left = -left
+			}
+			if right < 0 {
+				right = -right
+			}
+			if right < left {
+				into = k + 1
+			}
+		}
+		a, b := k, into
+		if a > b {
+			a, b = b, a
+		}
+		merged := Note{Start: notes[a].Start, Duration: notes[a].Duration + notes[b].Duration}
+		// the longer note decides the pitch
+		longer := notes[into]
+		merged.Pitch = Median(pitch[longer.Start:longer.End()])
+		notes[a] = merged
+		notes = append(notes[:b], notes[b+1:]...)
+	}
+	return notes
+}
+
+// NotesToPitch turns notes back into a pitch contour starting at the
+// first note. Rests between notes keep the pitch of the previous note,
+// like FixPitch does.
+func NotesToPitch(notes []Note) []PitchType {
+	if len(notes) == 0 {
+		return nil
+	}
+	first := notes[0].Start
+	last := notes[len(notes)-1]
+	out := make([]PitchType, last.End()-first)
+	for k, n := range notes {
+		end := len(out)
+		if k+1 < len(notes) {
+			end = notes[k+1].Start - first
+		}
+		for i := n.Start - first; i < end; i++ {
+			out[i] = n.Pitch
+		}
+	}
+	return out
+}
@@ -0,0 +1,116 @@
+package qbsh
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func repeatPitch(p PitchType, n int) []PitchType {
+	out := make([]PitchType, n)
+	for i := range out {
+		out[i] = p
+	}
+	return out
+}
+
+func TestSegmentNotes(t *testing.T) {
+	var pitch []PitchType
+	pitch = append(pitch, repeatPitch(60, 10)...)
+	pitch = append(pitch, repeatPitch(62, 10)...)
+	pitch = append(pitch, repeatPitch(-1, 3)...)
+	pitch = append(pitch, repeatPitch(64, 8)...)
+	// a blip too short to be a note
+	pitch = append(pitch, -1, 70, -1)
+	notes := SegmentNotes(pitch, DefaultNoteOptions())
+	want := []Note{{60, 0, 10}, {62, 10, 10}, {64, 23, 8}}
+	if !reflect.DeepEqual(notes, want) {
+		t.Errorf("got notes %v, want %v", notes, want)
+	}
+
+	frames := NotesToPitch(notes)
+	if len(frames) != 31 || frames[0] != 60 || frames[21] != 62 || frames[30] != 64 {
+		t.Errorf("wrong frames %v", frames)
+	}
+	if NotesToPitch(nil) != nil {
+		t.Error("no notes should give no frames")
+	}
+}
+
+func TestSegmentVibratoAndGlide(t *testing.T) {
+	var pitch []PitchType
+	// vibrato of 0.6 semitones at 6 Hz
+	for i := 0; i < 20; i++ {
+		pitch = append(pitch, 60+PitchType(0.6*math.Sin(2*math.Pi*6*float64(i)/20)))
+	}
+	// glide up to the next note
+	pitch = append(pitch, 61, 62, 63.5)
+	pitch = append(pitch, repeatPitch(65, 10)...)
+	notes := SegmentNotes(pitch, DefaultNoteOptions())
+	if len(notes) != 2 {
+		t.Fatalf("got notes %v, want 2 notes", notes)
+	}
+	if d := notes[0].Pitch - 60; d > 0.3 || d < -0.3 {
+		t.Errorf("vibrato note has pitch %v", notes[0].Pitch)
+	}
+	if notes[1].Pitch != 65 || notes[0].Duration+notes[1].Duration != len(pitch) {
+		t.Errorf("glide is not absorbed: %v", notes)
+	}
+}
+
+func notesPitch(notes []Note) []PitchType {
+	var out []PitchType
+	for _, n := range notes {
+		out = append(out, repeatPitch(n.Pitch, n.Duration)...)
+	}
+	return out
+}
+
+func TestNoteDistance(t *testing.T) {
+	song := []Note{{60, 0, 8}, {62, 8, 8}, {64, 16, 16}, {60, 32, 8}, {67, 40, 8}, {65, 48, 16}}
+	opts := DefaultNoteMatchOptions()
+	// part of the song, higher and twice as slow
+	var query []Note
+	for _, n := range song[1:5] {
+		query = append(query, Note{n.Pitch + 5, n.Start * 2, n.Duration * 2})
+	}
+	if d := NoteDistance(query, song, &opts); d != 0 {
+		t.Errorf("transposed and slower query has distance %v", d)
+	}
+	// wrong rhythm costs less than wrong notes
+	rhythm := append([]Note(nil), query...)
+	rhythm[1].Duration = 16
+	notes := append([]Note(nil), query...)
+	notes[1].Pitch -= 3
+	dr := NoteDistance(rhythm, song, &opts)
+	dn := NoteDistance(notes, song, &opts)
+	if dr <= 0 || dr >= dn {
+		t.Errorf("wrong rhythm has distance %v, wrong note %v", dr, dn)
+	}
+	if d := NoteDistance(query[:1], song, &opts); d != 0 {
+		t.Errorf("single note has distance %v", d)
+	}
+}
+
+func TestNoteFusion(t *testing.T) {
+	melody := []Note{{60, 0, 8}, {62, 8, 8}, {64, 16, 16}, {60, 32, 8}, {67, 40, 8}, {65, 48, 16}, {64, 64, 8}, {62, 72, 24}}
+	db := InitDatabase()
+	db.AddSong(MakeSong(notesPitch(append(melody, melody...)), "melody"), "melody")
+	other := []Note{{60, 0, 16}, {60, 16, 8}, {59, 24, 8}, {57, 32, 16}, {55, 48, 8}, {57, 56, 8}, {59, 64, 32}}
+	db.AddSong(MakeSong(notesPitch(append(other, other...)), "other"), "other")
+	// right notes with a rushed rhythm
+	query := append([]Note(nil), melody[:6]...)
+	for k := range query {
+		query[k].Duration = 6
+	}
+	opts := DefaultSearchOptions()
+	opts.NoFilter = true
+	opts.NoteMatch.Weight = 0.5
+	res := db.SearchWithOptions(notesPitch(query), opts)
+	if len(res.Songs) != 2 || res.Songs[0].SongId != "melody" {
+		t.Fatalf("fused search gives %v", res.Songs)
+	}
+	if res.Songs[0].NoteScore >= res.Songs[1].NoteScore {
+		t.Errorf("note scores %v and %v", res.Songs[0].NoteScore, res.Songs[1].NoteScore)
+	}
+}
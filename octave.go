@@ -0,0 +1,49 @@
+package qbsh
+
+import "math"
+
+// OctaveOptions configures FixOctave
+type OctaveOptions struct {
+	// frames on each side of a frame for its local median. A jump longer
+	// than this is a real change of octave and is kept
+	Window int
+	// semitones a jump may be away from whole octaves and still be folded
+	Tolerance PitchType
+}
+
+// DefaultOctaveOptions folds jumps shorter than 0.4 seconds of
+// GetWavPitch2 output
+func DefaultOctaveOptions() OctaveOptions {
+	return OctaveOptions{
+		Window:    8,
+		Tolerance: 1,
+	}
+}
+
+// FixOctave folds frames that are about a whole number of octaves away from
+// the median of frames around them into the octave of the median. Frames
+// of -1 are kept and do not count in the median.
+func FixOctave(pitch []PitchType, opts *OctaveOptions) []PitchType {
+	out := make([]PitchType, len(pitch))
+	copy(out, pitch)
+	around := make([]PitchType, 0, 2*opts.Window+1)
+	for i, p := range pitch {
+		if p == -1 {
+			continue
+		}
+		around = around[:0]
+		from := IntMax(i-opts.Window, 0)
+		to := IntMin(i+opts.Window+1, len(pitch))
+		for _, q := range pitch[from:to] {
+			if q != -1 {
+				around = append(around, q)
+			}
+		}
+		diff := p - Median(around)
+		octaves := PitchType(math.Round(float64(diff / 12)))
+		if octaves != 0 && math.Abs(float64(diff-12*octaves)) <= float64(opts.Tolerance) {
+			out[i] = p - 12*octaves
+		}
+	}
+	return out
+}
@@ -0,0 +1,254 @@
+package qbsh
+
+import (
+	"fmt"
+	"math"
+)
+
+// AnalysisSampleRate is the sample rate pitch trackers work at. Input
+// audio is resampled to it, which keeps frame sizes the same for all
+// inputs.
+const AnalysisSampleRate = 16000
+
+// input audio must have a sample rate in this range and at most
+// MaxChannels channels. Other rates are mistakes or broken headers, and
+// would make the resampler output far too much or nothing at all.
+const (
+	MinSampleRate = 4000
+	MaxSampleRate = 192000
+	MaxChannels   = 8
+)
+
+var ErrBadSampleRate = fmt.Errorf("sample rate must be from %d to %d Hz", MinSampleRate, MaxSampleRate)
+var ErrBadChannels = fmt.Errorf("audio must have 1 to %d channels", MaxChannels)
+
+// CheckAudioFormat returns an error if PrepareSamples does not take audio
+// with this many channels at sampleRate
+func CheckAudioFormat(channels, sampleRate int) error {
+	if channels < 1 || channels > MaxChannels {
+		return ErrBadChannels
+	}
+	if sampleRate < MinSampleRate || sampleRate > MaxSampleRate {
+		return ErrBadSampleRate
+	}
+	return nil
+}
+
+// level of prepared audio, and the most it is amplified
+const (
+	targetRMS    = 0.1
+	maxPeak      = 0.99
+	maxLevelGain = 100
+)
+
+// PrepareSamples mixes interleaved channels to mono, resamples to
+// AnalysisSampleRate and normalizes the level
+func PrepareSamples(samples []float64, channels, sampleRate int) ([]float64, error) {
+	if err := CheckAudioFormat(channels, sampleRate); err != nil {
+		return nil, err
+	}
+	resampler, err := NewResampler(sampleRate, AnalysisSampleRate)
+	if err != nil {
+		return nil, err
+	}
+	out := resampler.Resample(Downmix(samples, channels))
+	NormalizeLevel(out)
+	return out, nil
+}
+
+// Downmix averages interleaved channels
+func Downmix(samples []float64, channels int) []float64 {
+	if channels <= 1 {
+		return samples
+	}
+	out := make([]float64, len(samples)/channels)
+	for i := range out {
+		sum := 0.0
+		for c := 0; c < channels; c++ {
+			sum += samples[i*channels+c]
+		}
+		out[i] = sum / float64(channels)
+	}
+	return out
+}
+
+// NormalizeLevel scales samples in place to a fixed RMS level, without
+// clipping and without amplifying near silence too much
+func NormalizeLevel(samples []float64) {
+	sum, peak := 0.0, 0.0
+	for _, s := range samples {
+		sum += s * s
+		peak = math.Max(peak, math.Abs(s))
+	}
+	if peak == 0 {
+		return
+	}
+	rms := math.Sqrt(sum / float64(len(samples)))
+	gain := math.Min(targetRMS/rms, maxPeak/peak)
+	gain = math.Min(gain, maxLevelGain)
+	for i := range samples {
+		samples[i] *= gain
+	}
+}
+
+// Resampler converts audio between sample rates with a windowed sinc
+// filter, which also removes frequencies above the lower Nyquist rate.
+// Audio can be given in chunks.
+type Resampler struct {
+	// output sample n is at input position n * step / phases
+	step   int
+	phases int
+	// filter taps on each side of the output position
+	half   int
+	cutoff float64
+	// taps of each phase, nil if there are too many phases
+	table [][]float64
+	taps  []float64
+	// input history, buf[0] is input sample number base
+	buf     []float64
+	base    int
+	next    int
+	inCount int
+}
+
+// zero crossings of the sinc on each side of the filter
+const resamplerZeros = 16
+
+// at most this many phases are precomputed
+const resamplerMaxPhases = 4096
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// NewResampler makes a resampler from inRate to outRate. Both rates must
+// be from MinSampleRate to MaxSampleRate.
+func NewResampler(inRate, outRate int) (*Resampler, error) {
+	for _, rate := range []int{inRate, outRate} {
+		if rate < MinSampleRate || rate > MaxSampleRate {
+			return nil, ErrBadSampleRate
+		}
+	}
+	g := gcd(inRate, outRate)
+	r := &Resampler{
+		step:   inRate / g,
+		phases: outRate / g,
+	}
+	if r.step == r.phases {
+		return r, nil
+	}
+	// leave a little room for the transition band
+	r.cutoff = 0.92 * math.Min(1, float64(outRate)/float64(inRate))
+	r.half = int(math.Ceil(resamplerZeros / r.cutoff))
+	r.taps = make([]float64, 2*r.half)
+	if r.phases <= resamplerMaxPhases {
+		r.table = make([][]float64, r.phases)
+		for p := range r.table {
+			r.table[p] = make([]float64, 2*r.half)
+			r.makeTaps(p, r.table[p])
+		}
+	}
+	// samples before the start are silence
+	r.buf = make([]float64, r.half)
+	r.base = -r.half
+	return r, nil
+}
+
+// makeTaps computes the filter for output positions frac/phases after an
+// input sample. taps[j] multiplies input sample i - half + 1 + j.
+func (r *Resampler) makeTaps(frac int, taps []float64) {
+	sum := 0.0
+	for j := range taps {
+		d := float64(frac)/float64(r.phases) + float64(r.half-1-j)
+		x := r.cutoff * d
+		h := 1.0
+		if x != 0 {
+			h = math.Sin(math.Pi*x) / (math.Pi * x)
+		}
+		// Blackman window
+		w := d / float64(r.half)
+		if w <= -1 || w >= 1 {
+			h = 0
+		} else {
+			h *= 0.42 + 0.5*math.Cos(math.Pi*w) + 0.08*math.Cos(2*math.Pi*w)
+		}
+		taps[j] = h
+		sum += h
+	}
+	// keep constant signals at the same level
+	for j := range taps {
+		taps[j] /= sum
+	}
+}
+
+// Process resamples the next chunk of input. Output needs some input after
+// it, so it lags behind until Flush.
+func (r *Resampler) Process(in []float64) []float64 {
+	r.inCount += len(in)
+	if r.step == r.phases {
+		out := make([]float64, len(in))
+		copy(out, in)
+		return out
+	}
+	r.buf = append(r.buf, in...)
+	return r.produce(r.base + len(r.buf))
+}
+
+// Flush returns the rest of output and resets r for new audio
+func (r *Resampler) Flush() []float64 {
+	if r.step == r.phases {
+		r.inCount = 0
+		return nil
+	}
+	// pad with silence after the end
+	r.buf = append(r.buf, make([]float64, r.half)...)
+	out := r.produce(r.base + len(r.buf))
+	r.buf = make([]float64, r.half)
+	r.base = -r.half
+	r.next = 0
+	r.inCount = 0
+	return out
+}
+
+// Resample converts the whole of in, then resets r
+func (r *Resampler) Resample(in []float64) []float64 {
+	out := r.Process(in)
+	return append(out, r.Flush()...)
+}
+
+// produce makes output samples that need input before available, and
+// that are not after the end of input
+func (r *Resampler) produce(available int) []float64 {
+	var out []float64
+	for {
+		pos := r.next * r.step
+		i := pos / r.phases
+		if i >= r.inCount || i+r.half >= available {
+			break
+		}
+		frac := pos % r.phases
+		taps := r.taps
+		if r.table != nil {
+			taps = r.table[frac]
+		} else {
+			r.makeTaps(frac, taps)
+		}
+		start := i - r.half + 1 - r.base
+		sum := 0.0
+		for j, h := range taps {
+			sum += h * r.buf[start+j]
+		}
+		out = append(out, sum)
+		r.next++
+	}
+	// drop input no longer needed
+	keep := r.next*r.step/r.phases - r.half + 1
+	if drop := keep - r.base; drop > 0 {
+		r.buf = append(r.buf[:0], r.buf[drop:]...)
+		r.base = keep
+	}
+	return out
+}
@@ -0,0 +1,129 @@
+package qbsh
+
+import (
+	"sort"
+)
+
+// LowerBound returns a cheap lower bound of d.DTW_simd with the same
+// arguments. Every query frame is aligned to at least one song frame, so
+// it costs at least its distance to the pitch envelope of the range.
+// It also keeps the bound of each query suffix for DTW_early_abandon.
+func (d *DTW_tmp) LowerBound(song *Song, query []PitchType, from, to int, shift PitchType) PitchType {
+	if from >= to || len(query) == 0 {
+		return noMatchScore
+	}
+	lo := song.Pitch[from]
+	hi := song.Pitch[from]
+	for _, p := range song.Pitch[from:to] {
+		if p < lo {
+			lo = p
+		}
+		if p > hi {
+			hi = p
+		}
+	}
+	if len(d.Rest) < len(query)+1 {
+		d.Rest = make([]PitchType, len(query)+1)
+	}
+	d.Rest[len(query)] = 0
+	for j := len(query) - 1; j >= 0; j-- {
+		q := query[j] - shift
+		var dist PitchType
+		if q < lo {
+			dist = lo - q
+		} else if q > hi {
+			dist = q - hi
+		}
+		d.Rest[j] = d.Rest[j+1] + dist
+	}
+	return d.Rest[0]
+}
+
+// DTW_early_abandon computes the same score as DTW_simd, but gives up
+// when the score must be above limit and then returns a lower bound that
+// is above limit. It processes one query frame at a time, because every
+// alignment passes all query frames, so it cannot use SIMD. LowerBound
+// must be called with the same arguments first.
+func (d *DTW_tmp) DTW_early_abandon(song *Song, query []PitchType, from, to int, shift, limit PitchType) PitchType {
+	const inf PitchType = 999999
+	pitch := song.Pitch[from:to]
+	n := len(pitch)
+	if len(d.Row1) < n {
+		d.Row1 = make([]PitchType, n)
+		d.Row2 = make([]PitchType, n)
+	}
+	// row of the query frame before the first one, where alignment starts
+	prev := d.Row1[:n]
+	cur := d.Row2[:n]
+	for i := range prev {
+		prev[i] = 0
+	}
+	for j := range query {
+		q := query[j] - shift
+		rowMin := inf
+		left := inf
+		diag := PitchType(inf)
+		if j == 0 {
+			diag = 0
+		}
+		for i := 0; i < n; i++ {
+			diff := pitch[i] - q
+			if diff < 0 {
+				diff = -diff
+			}
+			v := prev[i]
+			if diag < v {
+				v = diag
+			}
+			if left < v {
+				v = left
+			}
+			diag = prev[i]
+			left = v + diff
+			cur[i] = left
+			if left < rowMin {
+				rowMin = left
+			}
+		}
+		if rowMin+d.Rest[j+1] > limit {
+			return rowMin + d.Rest[j+1]
+		}
+		prev, cur = cur, prev
+	}
+	ans := inf
+	for _, v := range prev {
+		if v < ans {
+			ans = v
+		}
+	}
+	return ans
+}
+
+// topScores keeps the k lowest scores seen, to know the score a song must
+// beat to enter the top k
+type topScores struct {
+	k      int
+	scores []PitchType
+}
+
+// limit returns the k-th best score so far
+func (t *topScores) limit() PitchType {
+	if t.k <= 0 || len(t.scores) < t.k {
+		return noMatchScore
+	}
+	return t.scores[t.k-1]
+}
+
+func (t *topScores) add(score PitchType) {
+	if t.k <= 0 || (len(t.scores) == t.k && score >= t.scores[t.k-1]) {
+		return
+	}
+	i := sort.Search(len(t.scores), func(i int) bool {
+		return t.scores[i] > score
+	})
+	if len(t.scores) < t.k {
+		t.scores = append(t.scores, 0)
+	}
+	copy(t.scores[i+1:], t.scores[i:])
+	t.scores[i] = score
+}
@@ -1,27 +1,103 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/stdio2016/qbsh"
+	"github.com/unixpickle/wav"
 )
 
 func main() {
+	snapshot := flag.String("snapshot", "", "binary database snapshot, created from the text database if it does not exist")
+	midiDir := flag.String("midi", "", "directory of MIDI files to add at startup")
+	journal := flag.String("journal", "", "log of songs added at runtime, replayed at startup")
+	compactInterval := flag.Duration("compact-interval", 10*time.Minute, "how often the journal is compacted into the snapshot")
+	maxUpload := flag.Int64("max-upload", 16<<20, "maximum size in bytes of WAV files posted to /searchWav")
+	maxSearchTime := flag.Duration("max-search-time", 0, "stop searches taking longer than this and return partial results, 0 means no limit")
+	pitchOpts := qbsh.DefaultPitchOptions()
+	flag.Float64Var(&pitchOpts.Fmin, "pitch-fmin", pitchOpts.Fmin, "lowest pitch found in WAV files, in Hz")
+	flag.Float64Var(&pitchOpts.Fmax, "pitch-fmax", pitchOpts.Fmax, "highest pitch found in WAV files, in Hz")
+	flag.IntVar(&pitchOpts.NThresholds, "pitch-thresholds", pitchOpts.NThresholds, "number of pYIN thresholds")
+	flag.Float64Var(&pitchOpts.BetaParameters.Alpha, "pitch-beta-alpha", pitchOpts.BetaParameters.Alpha, "alpha of the beta prior of pYIN thresholds")
+	flag.Float64Var(&pitchOpts.BetaParameters.Beta, "pitch-beta-beta", pitchOpts.BetaParameters.Beta, "beta of the beta prior of pYIN thresholds")
+	flag.Float64Var(&pitchOpts.Resolution, "pitch-resolution", pitchOpts.Resolution, "semitones between pYIN pitch states")
+	flag.Float64Var(&pitchOpts.MaxTransitionRate, "pitch-max-transition", pitchOpts.MaxTransitionRate, "fastest pitch change in semitones per second")
+	flag.Float64Var(&pitchOpts.VoicedProbability, "pitch-voiced-prob", pitchOpts.VoicedProbability, "frames less likely than this are unvoiced")
+	flag.IntVar(&pitchOpts.Downsample, "pitch-downsample", pitchOpts.Downsample, "pYIN frames, 100 per second, in each pitch frame, which are then resampled to the song frame rate")
+	useVAD := flag.Bool("vad", false, "detect voice activity before pitch tracking")
 	flag.Parse()
+	if *useVAD {
+		vad := qbsh.DefaultVADOptions()
+		pitchOpts.VAD = &vad
+	}
+	if err := checkPitchOptions(&pitchOpts); err != nil {
+		log.Fatalf("invalid pitch options: %v", err)
+	}
 
 	db := qbsh.InitDatabase()
-	if len(flag.Args()) >= 1 {
+	loaded := false
+	if *snapshot != "" {
+		err := db.LoadSnapshotFile(*snapshot)
+		if err == nil {
+			loaded = true
+			log.Default().Printf("loaded %d songs from snapshot\n", len(db.Songs))
+		} else if !os.IsNotExist(err) {
+			// rebuilding would overwrite the snapshot, so let the
+			// operator look at it first
+			log.Fatalf("cannot load snapshot %s: %v", *snapshot, err)
+		}
+	}
+	if !loaded && len(flag.Args()) >= 1 {
 		err := db.AddFromFile(flag.Arg(0))
 		if err != nil {
 			log.Default().Println("error while loading qbsh database")
 			log.Default().Println(err)
 		} else {
 			log.Default().Printf("added %d songs\n", len(db.Songs))
+			if *snapshot != "" {
+				err = db.SaveSnapshotFile(*snapshot)
+				if err != nil {
+					log.Default().Println("error while saving snapshot")
+					log.Default().Println(err)
+				}
+			}
+		}
+	}
+	if *midiDir != "" {
+		imports, err := db.AddFromMIDIDir(*midiDir)
+		if err != nil {
+			log.Default().Println("error while importing MIDI files")
+			log.Default().Println(err)
+		}
+		for _, imp := range imports {
+			log.Default().Printf("added %s from track %d channel %d polyphonic %v\n",
+				imp.File, imp.Track, imp.Channel+1, imp.Polyphonic)
+		}
+		log.Default().Printf("added %d MIDI songs\n", len(imports))
+	}
+	if *journal != "" {
+		count, err := db.AttachJournal(*journal)
+		if err != nil {
+			log.Fatalf("cannot open journal: %v", err)
+		}
+		log.Default().Printf("replayed %d journal records\n", count)
+		if *snapshot == "" {
+			log.Default().Println("journal will not be compacted without -snapshot")
+		} else if *compactInterval > 0 {
+			go compactPeriodically(db, *snapshot, *compactInterval)
 		}
 	}
 
@@ -40,11 +116,112 @@ func main() {
 		pitch := qbsh.ParsePitch(s_pitch)
 		song := qbsh.MakeSong(pitch, name)
 		song.Artist = artist
-		db.AddSong(song, songId)
+		err := db.AddSong(song, songId)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "{\"error\":\"cannot save song\"}")
+			log.Default().Printf("cannot add song %s: %v\n", songId, err)
+			return
+		}
 		fmt.Fprintf(w, "{\"message\":\"Added song\"}")
 		log.Default().Printf("Added song %s name %s\n", songId, name)
 	}
 
+	handleSongs := func(w http.ResponseWriter, r *http.Request) {
+		contentTypeJson(w)
+		if r.Method != http.MethodGet {
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "{\"error\":\"method not allowed\"}")
+			return
+		}
+		query := r.URL.Query()
+		limit := 50
+		if s_limit := query.Get("limit"); s_limit != "" {
+			n, err := strconv.Atoi(s_limit)
+			if err != nil || n <= 0 || n > 1000 {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "{\"error\":\"limit must be between 1 and 1000\"}")
+				return
+			}
+			limit = n
+		}
+		list, err := db.ListSongs(qbsh.SongListOptions{
+			SortBy: query.Get("sort"),
+			Filter: query.Get("q"),
+			Cursor: query.Get("cursor"),
+			Limit:  limit,
+		})
+		if err != nil {
+			w.WriteHeader(400)
+			b, _ := json.Marshal(map[string]string{"error": err.Error()})
+			w.Write(b)
+			return
+		}
+		b, _ := json.Marshal(list)
+		w.Write(b)
+	}
+
+	handleSong := func(w http.ResponseWriter, r *http.Request) {
+		contentTypeJson(w)
+		songId := strings.TrimPrefix(r.URL.Path, "/songs/")
+		if songId == "" || strings.Contains(songId, "/") {
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "{\"error\":\"not found\"}")
+			return
+		}
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			song, ok := db.GetSong(songId)
+			if !ok {
+				err = qbsh.ErrSongNotFound
+				break
+			}
+			withPitch := r.URL.Query().Get("pitch") == "1"
+			b, _ := json.Marshal(qbsh.MakeSongInfo(songId, song, withPitch))
+			w.Write(b)
+			return
+		case http.MethodDelete:
+			err = db.RemoveSong(songId)
+		case http.MethodPatch:
+			r.ParseForm()
+			song, ok := db.GetSong(songId)
+			if !ok {
+				err = qbsh.ErrSongNotFound
+				break
+			}
+			name, artist := song.Name, song.Artist
+			if _, ok := r.Form["name"]; ok {
+				name = r.Form.Get("name")
+			}
+			if _, ok := r.Form["artist"]; ok {
+				artist = r.Form.Get("artist")
+			}
+			err = db.UpdateMetadata(songId, name, artist)
+		default:
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "{\"error\":\"method not allowed\"}")
+			return
+		}
+		if err == qbsh.ErrSongNotFound {
+			w.WriteHeader(404)
+			fmt.Fprintf(w, "{\"error\":\"song not found\"}")
+			return
+		} else if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "{\"error\":\"cannot save song\"}")
+			log.Default().Printf("cannot change song %s: %v\n", songId, err)
+			return
+		}
+		if r.Method == http.MethodDelete {
+			fmt.Fprintf(w, "{\"message\":\"Removed song\"}")
+			log.Default().Printf("Removed song %s\n", songId)
+		} else {
+			fmt.Fprintf(w, "{\"message\":\"Updated song\"}")
+			log.Default().Printf("Updated song %s\n", songId)
+		}
+	}
+
 	handleSearch := func(w http.ResponseWriter, r *http.Request) {
 		contentTypeJson(w)
 		s_pitch := r.URL.Query().Get("pitch")
@@ -54,73 +231,268 @@ func main() {
 			fmt.Fprintf(w, "{\"error\":\"pitch must not be empty\"}")
 			return
 		}
+		opts, err := parseSearchOptions(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(400)
+			b, _ := json.Marshal(map[string]string{"error": err.Error()})
+			w.Write(b)
+			return
+		}
 		time_2 := time.Now()
-		result := db.Search(pitch)
+		ctx, cancel := searchContext(r, *maxSearchTime)
+		defer cancel()
+		result, err := db.SearchContext(ctx, pitch, opts)
 		time_3 := time.Now()
 		result.Reason = fmt.Sprintf("search %dms",
 			time_3.Sub(time_2).Milliseconds())
+		if err != nil {
+			result.Progress = "error"
+			result.Reason = fmt.Sprintf("search stopped after %dms: %v",
+				time_3.Sub(time_2).Milliseconds(), err)
+		}
 		b, _ := json.Marshal(result)
 		w.Write(b)
 		log.Default().Printf("Search song with pitch %v\n", pitch)
 	}
 
+	// searchWavPitch searches pitch extracted from a recording at time_1
+	searchWavPitch := func(w http.ResponseWriter, r *http.Request, opts qbsh.SearchOptions, pitch []qbsh.PitchType, voicing []float64, time_1 time.Time) {
+		pitch, voicing = qbsh.ToPitchFrameRate(pitch, voicing, pitchOpts.FrameRate())
+		pitch = qbsh.FixPitchVoicing(pitch, voicing)
+		if len(pitch) == 0 {
+			writeResultError(w, "Cannot analyze pitch. Maybe it is silent or full of noise.")
+			return
+		}
+		time_2 := time.Now()
+		ctx, cancel := searchContext(r, *maxSearchTime)
+		defer cancel()
+		result, err := db.SearchContext(ctx, pitch, opts)
+		time_3 := time.Now()
+		result.Reason = fmt.Sprintf("pitch %dms search %dms",
+			time_2.Sub(time_1).Milliseconds(),
+			time_3.Sub(time_2).Milliseconds())
+		if err != nil {
+			result.Progress = "error"
+			result.Reason = fmt.Sprintf("search stopped after %dms: %v",
+				time_3.Sub(time_2).Milliseconds(), err)
+		}
+		b, _ := json.Marshal(result)
+		w.Write(b)
+	}
+
 	handleSearchLocalWav := func(w http.ResponseWriter, r *http.Request) {
 		contentTypeJson(w)
 		filename := r.URL.Query().Get("file")
 		if filename == "" {
-			result := qbsh.Result{
-				Progress: "error",
-				Reason:   "file must not be empty",
-			}
-			b, _ := json.Marshal(result)
-			w.Write(b)
+			writeResultError(w, "file must not be empty")
 			return
 		}
-		time_1 := time.Now()
-		pitch, err := qbsh.GetWavPitch2(filename)
+		opts, err := parseSearchOptions(r.URL.Query())
 		if err != nil {
-			result := qbsh.Result{
-				Progress: "error",
-				Reason:   err.Error(),
-			}
-			b, _ := json.Marshal(result)
-			w.Write(b)
+			writeResultError(w, err.Error())
 			return
 		}
-		pitch = qbsh.FixPitch(pitch)
-		if len(pitch) == 0 {
-			result := qbsh.Result{
-				Progress: "error",
-				Reason:   "Cannot analyze pitch. Maybe it is silent or full of noise.",
-			}
-			b, _ := json.Marshal(result)
-			w.Write(b)
+		time_1 := time.Now()
+		pitch, voicing, err := qbsh.GetWavPitchWithOptions(filename, pitchOpts)
+		if err != nil {
+			writeResultError(w, err.Error())
 			return
 		}
-		time_2 := time.Now()
-		result := db.Search(pitch)
-		time_3 := time.Now()
-		result.Reason = fmt.Sprintf("pitch %dms search %dms",
-			time_2.Sub(time_1).Milliseconds(),
-			time_3.Sub(time_2).Milliseconds())
-		b, _ := json.Marshal(result)
-		w.Write(b)
+		searchWavPitch(w, r, opts, pitch, voicing, time_1)
 		log.Default().Printf("search local file %s\n", filename)
 	}
+
+	handleSearchWav := func(w http.ResponseWriter, r *http.Request) {
+		contentTypeJson(w)
+		if r.Method != http.MethodPost {
+			w.WriteHeader(405)
+			fmt.Fprintf(w, "{\"error\":\"method not allowed\"}")
+			return
+		}
+		opts, err := parseSearchOptions(r.URL.Query())
+		if err != nil {
+			writeResultError(w, err.Error())
+			return
+		}
+		body, status, err := readWavUpload(w, r, *maxUpload)
+		if err != nil {
+			w.WriteHeader(status)
+			writeResultError(w, err.Error())
+			return
+		}
+		time_1 := time.Now()
+		pitch, voicing, err := qbsh.GetReaderPitchWithOptions(bytes.NewReader(body), pitchOpts)
+		if err != nil {
+			w.WriteHeader(400)
+			writeResultError(w, err.Error())
+			return
+		}
+		searchWavPitch(w, r, opts, pitch, voicing, time_1)
+		log.Default().Printf("search uploaded WAV of %d bytes\n", len(body))
+	}
 	handlePing := func(w http.ResponseWriter, _ *http.Request) {
 		contentTypeJson(w)
 		fmt.Fprint(w, "{\"status\":\"ok\"}")
 	}
 
 	http.HandleFunc("/add", handleAdd)
+	http.HandleFunc("/songs", handleSongs)
+	http.HandleFunc("/songs/", handleSong)
 	http.HandleFunc("/search", handleSearch)
 	http.HandleFunc("/searchLocalWav", handleSearchLocalWav)
+	http.HandleFunc("/searchWav", handleSearchWav)
 	http.HandleFunc("/ping", handlePing)
 
 	log.Default().Printf("Started server\n")
 	http.ListenAndServe(":1606", nil)
 }
 
+// searchContext is cancelled when the client disconnects or the search
+// takes longer than maxTime
+// checkPitchOptions validates opts for tracking queries. Query pitch is
+// resampled to the song frame rate, so a slower pitch frame rate would
+// only repeat frames.
+func checkPitchOptions(opts *qbsh.PitchOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	if opts.FrameRate() < qbsh.PitchFrameRate {
+		return fmt.Errorf("pitch downsample %d gives %g frames per second, fewer than the %d of songs",
+			opts.Downsample, opts.FrameRate(), qbsh.PitchFrameRate)
+	}
+	return nil
+}
+
+func searchContext(r *http.Request, maxTime time.Duration) (context.Context, context.CancelFunc) {
+	if maxTime > 0 {
+		return context.WithTimeout(r.Context(), maxTime)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// widest DTW band accepted by search requests. Each search goroutine
+// keeps three rows of 2*band+1 cells per query frame
+const maxBand = 100
+
+// parseSearchOptions reads search options from query parameters, using
+// defaults for missing ones
+func parseSearchOptions(query url.Values) (qbsh.SearchOptions, error) {
+	opts := qbsh.DefaultSearchOptions()
+	ints := map[string]*int{
+		"topK":         &opts.TopK,
+		"parallelism":  &opts.Parallelism,
+		"band":         &opts.Constraint.Band,
+		"lsCandidates": &opts.LinearScaling.Candidates,
+	}
+	floats := map[string]*float64{
+		"avgCutoff":      &opts.AverageCutoff,
+		"relativeCutoff": &opts.RelativeCutoff,
+		"stdDevCutoff":   &opts.StdDevCutoff,
+		"noteWeight":     &opts.NoteMatch.Weight,
+	}
+	pitches := map[string]*qbsh.PitchType{
+		"maxScore": &opts.MaxScore,
+		"avgFloor": &opts.AverageFloor,
+	}
+	bools := map[string]*bool{
+		"noFilter":     &opts.NoFilter,
+		"debug":        &opts.Debug,
+		"limitSlope":   &opts.Constraint.LimitSlope,
+		"alignment":    &opts.Alignment,
+		"keyInvariant": &opts.KeyInvariant,
+	}
+	for name, p := range ints {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("%s must be a non-negative integer", name)
+			}
+			*p = n
+		}
+	}
+	if opts.Constraint.Band > maxBand {
+		return opts, fmt.Errorf("band must be at most %d", maxBand)
+	}
+	for name, p := range floats {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("%s must be a non-negative number", name)
+			}
+			*p = n
+		}
+	}
+	for name, p := range pitches {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.ParseFloat(v, 32)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("%s must be a non-negative number", name)
+			}
+			*p = qbsh.PitchType(n)
+		}
+	}
+	for name, p := range bools {
+		if v := query.Get(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, fmt.Errorf("%s must be true or false", name)
+			}
+			*p = b
+		}
+	}
+	return opts, nil
+}
+
+// readWavUpload reads a WAV file posted to r and checks its header, which
+// the WAV reader and the resampler trust. On error it also returns the
+// HTTP status to answer.
+func readWavUpload(w http.ResponseWriter, r *http.Request, maxUpload int64) ([]byte, int, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUpload))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, 413, fmt.Errorf("WAV file must be at most %d bytes", maxUpload)
+	}
+	if err != nil {
+		return nil, 400, err
+	}
+	header, err := wav.ReadHeader(bytes.NewReader(body))
+	if err != nil {
+		return nil, 400, err
+	}
+	if int64(header.Data.Size) > int64(len(body)) {
+		return nil, 400, errors.New("WAV data is shorter than its header says")
+	}
+	if err := qbsh.CheckAudioFormat(int(header.Format.NumChannels), int(header.Format.SampleRate)); err != nil {
+		return nil, 400, err
+	}
+	return body, 200, nil
+}
+
+func compactPeriodically(db *qbsh.Database, snapshot string, interval time.Duration) {
+	for range time.Tick(interval) {
+		if db.Journal.Size() == 0 {
+			continue
+		}
+		err := db.Compact(snapshot)
+		if err != nil {
+			log.Default().Println("error while compacting journal")
+			log.Default().Println(err)
+		} else {
+			log.Default().Printf("compacted journal into %s\n", snapshot)
+		}
+	}
+}
+
 func contentTypeJson(w http.ResponseWriter) {
 	w.Header().Add("Content-Type", "application/json; charset=utf-8")
 }
+
+// writeResultError writes a search result that failed for reason
+func writeResultError(w http.ResponseWriter, reason string) {
+	result := qbsh.Result{
+		Progress: "error",
+		Reason:   reason,
+	}
+	b, _ := json.Marshal(result)
+	w.Write(b)
+}
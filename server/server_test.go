@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stdio2016/qbsh"
+	"github.com/unixpickle/wav"
+)
+
+func postWav(t *testing.T, channels, sampleRate int, dataSize uint32, maxUpload int64) (int, error) {
+	header := wav.NewHeader()
+	header.Format.NumChannels = uint16(channels)
+	header.Format.SampleRate = uint32(sampleRate)
+	header.Format.BitsPerSample = 16
+	header.Data.Size = dataSize
+	var buf bytes.Buffer
+	if err := header.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(make([]byte, 2000))
+	r := httptest.NewRequest("POST", "/searchWav", &buf)
+	w := httptest.NewRecorder()
+	_, status, err := readWavUpload(w, r, maxUpload)
+	return status, err
+}
+
+func TestReadWavUpload(t *testing.T) {
+	if status, err := postWav(t, 1, 8000, 2000, 1<<20); status != 200 || err != nil {
+		t.Errorf("good WAV gives status %d error %v", status, err)
+	}
+	bad := []struct {
+		channels, sampleRate int
+		dataSize             uint32
+		maxUpload            int64
+		status               int
+	}{
+		{1, 0, 2000, 1 << 20, 400},
+		{1, 1, 2000, 1 << 20, 400},
+		{1, 1000000, 2000, 1 << 20, 400},
+		{0, 8000, 2000, 1 << 20, 400},
+		{1, 8000, 1 << 30, 1 << 20, 400},
+		{1, 8000, 2000, 1000, 413},
+	}
+	for _, c := range bad {
+		status, err := postWav(t, c.channels, c.sampleRate, c.dataSize, c.maxUpload)
+		if status != c.status || err == nil {
+			t.Errorf("%d channels at %d Hz, %d bytes of data, limit %d: status %d error %v, want status %d",
+				c.channels, c.sampleRate, c.dataSize, c.maxUpload, status, err, c.status)
+		}
+	}
+}
+
+func TestParseSearchOptions(t *testing.T) {
+	opts, err := parseSearchOptions(url.Values{"band": {"10"}})
+	if err != nil || opts.Constraint.Band != 10 {
+		t.Errorf("band 10 gives %+v error %v", opts.Constraint, err)
+	}
+	if _, err := parseSearchOptions(url.Values{"band": {"1000000"}}); err == nil {
+		t.Error("huge band gives no error")
+	}
+}
+
+func TestCheckPitchOptions(t *testing.T) {
+	opts := qbsh.DefaultPitchOptions()
+	for downsample := 1; downsample <= 8; downsample++ {
+		opts.Downsample = downsample
+		err := checkPitchOptions(&opts)
+		if ok := opts.FrameRate() >= qbsh.PitchFrameRate; ok != (err == nil) {
+			t.Errorf("downsample %d gives error %v", downsample, err)
+		}
+	}
+}
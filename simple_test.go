@@ -1,9 +1,18 @@
 package qbsh
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"testing"
 )
 
@@ -24,6 +33,80 @@ func TestAdd(t *testing.T) {
 	}
 }
 
+func TestRemoveAndUpdate(t *testing.T) {
+	db := InitDatabase()
+	pitch := make([]PitchType, 100)
+	for i := range pitch {
+		pitch[i] = 60
+	}
+	song := MakeSong(pitch, "SongA")
+	db.AddSong(song, "1")
+	if err := db.UpdateMetadata("1", "SongB", "Someone"); err != nil {
+		t.Fatal(err)
+	}
+	got := db.Songs["1"]
+	if got.Name != "SongB" || got.Artist != "Someone" || &got.Ranges[0] != &song.Ranges[0] {
+		t.Error("metadata not updated or ranges recomputed")
+	}
+	if song.Name != "SongA" {
+		t.Error("old song is modified")
+	}
+	if err := db.RemoveSong("1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RemoveSong("1"); err != ErrSongNotFound {
+		t.Errorf("removing unknown song gives error %v", err)
+	}
+	if err := db.UpdateMetadata("1", "", ""); err != ErrSongNotFound {
+		t.Errorf("updating unknown song gives error %v", err)
+	}
+}
+
+func TestListSongs(t *testing.T) {
+	db := InitDatabase()
+	for i := 0; i < 25; i++ {
+		song := MakeSong([]PitchType{1, 2, 3}, fmt.Sprintf("Song %c", 'z'-i))
+		if i%5 == 0 {
+			song.Artist = "Bee"
+		}
+		db.AddSong(song, fmt.Sprintf("%02d", i))
+	}
+	var names []string
+	opts := SongListOptions{SortBy: "name", Limit: 10}
+	for {
+		list, err := db.ListSongs(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range list.Songs {
+			names = append(names, info.Name)
+		}
+		if list.NextCursor == "" {
+			break
+		}
+		opts.Cursor = list.NextCursor
+	}
+	if len(names) != 25 || !sort.StringsAreSorted(names) {
+		t.Errorf("wrong pages %v", names)
+	}
+
+	list, _ := db.ListSongs(SongListOptions{Filter: "bee"})
+	if list.Total != 5 || list.Songs[0].SongId != "00" {
+		t.Errorf("wrong filter result %v", list)
+	}
+	if _, err := db.ListSongs(SongListOptions{Cursor: "?"}); err != ErrBadCursor {
+		t.Errorf("bad cursor gives error %v", err)
+	}
+	list, _ = db.ListSongs(SongListOptions{SortBy: "name", Limit: 10})
+	if _, err := db.ListSongs(SongListOptions{SortBy: "artist", Cursor: list.NextCursor}); err != ErrBadCursor {
+		t.Errorf("cursor of another sort order gives error %v", err)
+	}
+	list, _ = db.ListSongs(SongListOptions{Limit: 10})
+	if _, err := db.ListSongs(SongListOptions{SortBy: "id", Cursor: list.NextCursor}); err != nil {
+		t.Errorf("cursor of default sort order gives error %v", err)
+	}
+}
+
 func TestSearch1(t *testing.T) {
 	db := InitDatabase()
 	db.AddSong(MakeSong([]PitchType{1, 2, 3}, "SongA"), "1")
@@ -32,6 +115,207 @@ func TestSearch1(t *testing.T) {
 	db.Search(query)
 }
 
+func TestSearchOptions(t *testing.T) {
+	db := InitDatabase()
+	rand.Seed(1)
+	pitch := RandPitch(200)
+	db.AddSong(MakeSong(pitch, "SongA"), "0")
+	for i := 1; i < 10; i++ {
+		db.AddSong(MakeSong(RandPitch(200), "Other"), strconv.Itoa(i))
+	}
+	query := pitch[50:100]
+	result := db.Search(query)
+	if len(result.Songs) != 1 || result.Songs[0].SongId != "0" || result.Debug != nil {
+		t.Errorf("default search gives %v", result.Songs)
+	}
+	opts := DefaultSearchOptions()
+	opts.NoFilter = true
+	opts.TopK = 0
+	opts.Debug = true
+	result = db.SearchWithOptions(query, opts)
+	if result.Debug == nil || len(result.Songs) != result.Debug.Matched || len(result.Songs) < 5 {
+		t.Errorf("unfiltered search gives %d songs", len(result.Songs))
+	}
+	opts.TopK = 3
+	result = db.SearchWithOptions(query, opts)
+	if len(result.Songs) != 3 {
+		t.Errorf("top 3 search gives %d songs", len(result.Songs))
+	}
+}
+
+func TestParallelSearch(t *testing.T) {
+	db := InitDatabase()
+	rand.Seed(2)
+	for i := 0; i < 20; i++ {
+		db.AddSong(MakeSong(RandPitch(150), "Song"), strconv.Itoa(i))
+	}
+	// a duplicate song must tie and keep id order
+	db.AddSong(db.Songs["7"], "17b")
+	query := db.Songs["7"].Pitch[20:80]
+	opts := DefaultSearchOptions()
+	opts.NoFilter = true
+	opts.Parallelism = 1
+	want := db.SearchWithOptions(query, opts)
+	opts.Parallelism = 4
+	got := db.SearchWithOptions(query, opts)
+	if !reflect.DeepEqual(want, got) {
+		t.Error("parallel search gives different result")
+	}
+	if got.Songs[0].SongId != "17b" || got.Songs[1].SongId != "7" {
+		t.Errorf("tie is not sorted by id: %v", got.Songs[:2])
+	}
+}
+
+func TestSearchCancel(t *testing.T) {
+	db := InitDatabase()
+	for i := 0; i < 5; i++ {
+		db.AddSong(MakeSong(RandPitch(150), "Song"), strconv.Itoa(i))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, err := db.SearchContext(ctx, RandPitch(50), DefaultSearchOptions())
+	if err != context.Canceled || len(result.Songs) != 0 {
+		t.Errorf("cancelled search gives %v %v", err, result.Songs)
+	}
+}
+
+func TestPrunedSearch(t *testing.T) {
+	bytes, err := os.ReadFile("testdata/littlebee.txt")
+	if err != nil {
+		t.Fatal("test data not found!")
+	}
+	dat := string(bytes)
+	pitch := ParsePitch(dat[:len(dat)-1])
+	db := InitDatabase()
+	db.AddSong(MakeSong(pitch, "little bee"), "bee")
+	rand.Seed(3)
+	for i := 0; i < 20; i++ {
+		db.AddSong(MakeSong(RandPitch(300), "Song"), strconv.Itoa(i))
+	}
+	query := pitch[40:168]
+	opts := DefaultSearchOptions()
+	opts.TopK = 3
+	opts.NoFilter = true
+	opts.Debug = true
+	opts.Parallelism = 1
+	want := db.SearchWithOptions(query, opts)
+	for _, abandon := range []bool{false, true} {
+		opts.Prune = true
+		opts.EarlyAbandon = abandon
+		got := db.SearchWithOptions(query, opts)
+		if !reflect.DeepEqual(want.Songs, got.Songs) {
+			t.Errorf("pruned search gives %v, want %v", got.Songs, want.Songs)
+		}
+		if got.Debug.Pruned == 0 {
+			t.Error("nothing is pruned")
+		}
+		if abandon && got.Debug.Abandoned == 0 {
+			t.Error("nothing is abandoned")
+		}
+	}
+
+	// cut-offs on the average need every score, so pruning keeps them
+	opts = DefaultSearchOptions()
+	opts.TopK = 3
+	opts.Debug = true
+	opts.Parallelism = 1
+	for _, q := range [][]PitchType{query, RandPitch(100)} {
+		opts.Prune = false
+		opts.EarlyAbandon = false
+		want := db.SearchWithOptions(q, opts)
+		for _, abandon := range []bool{false, true} {
+			opts.Prune = true
+			opts.EarlyAbandon = abandon
+			got := db.SearchWithOptions(q, opts)
+			if !reflect.DeepEqual(want.Songs, got.Songs) {
+				t.Errorf("pruned search with filters gives %v, want %v", got.Songs, want.Songs)
+			}
+			if got.Debug.Average != want.Debug.Average || got.Debug.StdDev != want.Debug.StdDev {
+				t.Errorf("pruned search has average %v stdev %v, want %v and %v",
+					got.Debug.Average, got.Debug.StdDev, want.Debug.Average, want.Debug.StdDev)
+			}
+		}
+	}
+}
+
+func TestLinearScaling(t *testing.T) {
+	bytes, err := os.ReadFile("testdata/littlebee.txt")
+	if err != nil {
+		t.Fatal("test data not found!")
+	}
+	dat := string(bytes)
+	pitch := ParsePitch(dat[:len(dat)-1])
+	db := InitDatabase()
+	bee := MakeSong(pitch, "little bee")
+	db.AddSong(bee, "bee")
+	rand.Seed(4)
+	for i := 0; i < 20; i++ {
+		db.AddSong(MakeSong(RandPitch(300), "Song"), strconv.Itoa(i))
+	}
+	// hum 1.5 times slower and a bit higher
+	var query []PitchType
+	for k := 0; k < 192; k++ {
+		query = append(query, pitch[40+k*2/3]+3)
+	}
+	ls := DefaultLinearScalingOptions()
+	sco, from, to := LinearScaling(bee, query, &ls)
+	if sco > 1 {
+		t.Errorf("linear scaling of stretched query is %v, want at most 1", sco)
+	}
+	if from < 30 || from > 50 || to < 158 || to > 178 {
+		t.Errorf("linear scaling matches %d-%d, want about 40-168", from, to)
+	}
+
+	opts := DefaultSearchOptions()
+	opts.Debug = true
+	opts.LinearScaling.Candidates = 3
+	res := db.SearchWithOptions(query, opts)
+	if len(res.Songs) == 0 || res.Songs[0].SongId != "bee" {
+		t.Errorf("search with linear scaling gives %v", res.Songs)
+	}
+	if res.Debug.Filtered != 18 {
+		t.Errorf("%d songs filtered, want 18", res.Debug.Filtered)
+	}
+}
+
+func TestKeyInvariantSearch(t *testing.T) {
+	bytes, err := os.ReadFile("testdata/littlebee.txt")
+	if err != nil {
+		t.Fatal("test data not found!")
+	}
+	dat := string(bytes)
+	pitch := ParsePitch(dat[:len(dat)-1])
+	db := InitDatabase()
+	db.AddSong(MakeSong(pitch, "little bee"), "bee")
+	rand.Seed(6)
+	for i := 0; i < 20; i++ {
+		db.AddSong(MakeSong(RandPitch(300), "Song"), strconv.Itoa(i))
+	}
+	opts := DefaultSearchOptions()
+	opts.KeyInvariant = true
+	opts.Debug = true
+	var scores []PitchType
+	for _, key := range []PitchType{0, 2.5, -7.3} {
+		query := make([]PitchType, 128)
+		for i := range query {
+			query[i] = pitch[40+i] + key
+		}
+		res := db.SearchWithOptions(query, opts)
+		if len(res.Songs) == 0 || res.Songs[0].SongId != "bee" {
+			t.Fatalf("key %v: key invariant search gives %v", key, res.Songs)
+		}
+		if res.Debug.Ranges != res.Debug.Matched {
+			t.Errorf("key %v: %d ranges compared for %d songs", key, res.Debug.Ranges, res.Debug.Matched)
+		}
+		scores = append(scores, res.Songs[0].Score)
+	}
+	for _, sco := range scores[1:] {
+		if d := sco - scores[0]; d > 0.01 || d < -0.01 {
+			t.Errorf("transposed query scores %v, want %v", sco, scores[0])
+		}
+	}
+}
+
 func TestSearch2(t *testing.T) {
 	var d DTW_tmp
 	for i := 1; i <= 10; i++ {
@@ -50,6 +334,349 @@ func TestSearch2(t *testing.T) {
 	}
 }
 
+// bruteConstrainedDTW runs a separate DTW for every start frame, checking
+// the band on every cell, and returns the best score
+func bruteConstrainedDTW(song, query []PitchType, shift PitchType, c DTWConstraint) PitchType {
+	type move struct{ di, dj, mi, mj int }
+	moves := []move{{-1, 0, 0, 0}, {-1, -1, 0, 0}, {0, -1, 0, 0}}
+	if c.LimitSlope {
+		moves = []move{{-1, -1, 0, 0}, {-2, -1, -1, 0}, {-1, -2, 0, -1}}
+	}
+	n1, n2 := len(song), len(query)
+	if c.Band > n2 {
+		c.Band = n2
+	}
+	cost := func(i, j int) PitchType {
+		return dtwCost(song[i], query[j]-shift)
+	}
+	best := dtwInf
+	for s := 0; s < n1; s++ {
+		inBand := func(i, j int) bool {
+			off := i - s - j
+			return c.Band <= 0 || off <= c.Band && off >= -c.Band
+		}
+		dp := make([][]PitchType, n1)
+		// the path starts from (s-1, -1), stepping into song frame s
+		get := func(i, j int) PitchType {
+			if j == -1 && i == s-1 {
+				return 0
+			}
+			if i < 0 || j < 0 {
+				return dtwInf
+			}
+			return dp[i][j]
+		}
+		for i := range dp {
+			dp[i] = make([]PitchType, n2)
+			for j := range dp[i] {
+				dp[i][j] = dtwInf
+				if !inBand(i, j) {
+					continue
+				}
+				for _, m := range moves {
+					if j+m.dj == -1 && m.di == 0 {
+						continue
+					}
+					p := get(i+m.di, j+m.dj)
+					if p >= dtwInf {
+						continue
+					}
+					if m.mi != 0 || m.mj != 0 {
+						if !inBand(i+m.mi, j+m.mj) {
+							continue
+						}
+						p += cost(i+m.mi, j+m.mj)
+					}
+					if p+cost(i, j) < dp[i][j] {
+						dp[i][j] = p + cost(i, j)
+					}
+				}
+			}
+			if dp[i][n2-1] < best {
+				best = dp[i][n2-1]
+			}
+		}
+	}
+	return best
+}
+
+func TestConstrainedDTWExact(t *testing.T) {
+	rand.Seed(11)
+	for n := 0; n < 900; n++ {
+		query := RandPitch(rand.Intn(12) + 1)
+		song := RandPitch(rand.Intn(30) + 1)
+		c := DTWConstraint{Band: rand.Intn(5), LimitSlope: rand.Intn(2) == 1}
+		want := bruteConstrainedDTW(song, query, 0.5, c)
+		got, from, to := DTW_find_where_constrained(song, query, 0.5, c)
+		if d := got - want; d > 0.001 || d < -0.001 {
+			t.Fatalf("case %d %+v: got %v, brute force gives %v", n, c, got, want)
+		}
+		if got < dtwInf {
+			if sco := bruteConstrainedDTW(song[from:to+1], query, 0.5, c); sco != got {
+				t.Errorf("case %d %+v: match %d-%d scores %v alone, want %v", n, c, from, to, sco, got)
+			}
+		}
+	}
+}
+
+func TestConstrainedDTW(t *testing.T) {
+	var d DTW_tmp
+	rand.Seed(5)
+	constraints := []DTWConstraint{{}, {Band: 3}, {LimitSlope: true}, {Band: 2, LimitSlope: true}}
+	for i := 1; i <= 12; i++ {
+		for j := 1; j <= 30; j += 3 {
+			query := RandPitch(i)
+			song := MakeSong(RandPitch(j), "name")
+			for k := range query {
+				query[k] += PitchType(rand.Float32())
+			}
+			shift := PitchType(1.5)
+			plain := DTW_constrained(song.Pitch, query, shift, DTWConstraint{})
+			for _, c := range constraints {
+				ans1 := DTW_constrained(song.Pitch, query, shift, c)
+				ans2 := d.DTW_range_constrained(song, query, 0, j, shift, c)
+				ans3, from, to := DTW_find_where_constrained(song.Pitch, query, shift, c)
+				if ans1 != ans2 || ans1 != ans3 {
+					t.Errorf("query %d song %d %+v: scalar %v, reused buffers %v, find_where %v", i, j, c, ans1, ans2, ans3)
+				}
+				if ans1 < plain {
+					t.Errorf("query %d song %d %+v: constrained %v better than %v", i, j, c, ans1, plain)
+				}
+				if ans1 < dtwInf && (from < 0 || to >= j || from > to) {
+					t.Errorf("query %d song %d %+v: bad match %d-%d", i, j, c, from, to)
+				}
+			}
+		}
+	}
+
+	// a held note must not absorb a short hum
+	var song, query []PitchType
+	for _, p := range []PitchType{60, 62, 64} {
+		for k := 0; k < 100; k++ {
+			song = append(song, p)
+		}
+		for k := 0; k < 5; k++ {
+			query = append(query, p)
+		}
+	}
+	if sco := DTW(song, query, 0); sco != 0 {
+		t.Errorf("unconstrained DTW gives %v, want 0", sco)
+	}
+	if sco := DTW_constrained(song, query, 0, DTWConstraint{LimitSlope: true}); sco == 0 {
+		t.Error("slope constraint allows stretching a note 20 times")
+	}
+	if sco := DTW_constrained(song, query, 0, DTWConstraint{Band: 10}); sco == 0 {
+		t.Error("band allows stretching a note 20 times")
+	}
+}
+
+func TestAlignment(t *testing.T) {
+	rand.Seed(7)
+	constraints := []DTWConstraint{{}, {Band: 3}, {LimitSlope: true}, {Band: 2, LimitSlope: true}}
+	for i := 1; i <= 12; i++ {
+		for j := 1; j <= 30; j += 3 {
+			query := RandPitch(i)
+			song := RandPitch(j)
+			for _, c := range constraints {
+				want := DTW_constrained(song, query, 1, c)
+				sco, path := DTW_path(song, query, 1, c)
+				if sco != want {
+					t.Errorf("query %d song %d %+v: path score %v, want %v", i, j, c, sco, want)
+				}
+				if sco >= dtwInf {
+					if path != nil {
+						t.Errorf("query %d song %d %+v: path without match", i, j, c)
+					}
+					continue
+				}
+				if path[0].Query != 0 || path[len(path)-1].Query != i-1 {
+					t.Errorf("query %d song %d %+v: path does not cover query", i, j, c)
+				}
+				var sum PitchType
+				for k, step := range path {
+					sum += step.Cost
+					if step.Song < 0 || step.Song >= j {
+						t.Errorf("query %d song %d %+v: song frame %d out of range", i, j, c, step.Song)
+					}
+					if k == 0 {
+						continue
+					}
+					dq := step.Query - path[k-1].Query
+					ds := step.Song - path[k-1].Song
+					if dq < 0 || ds < 0 || dq > 1 || ds > 1 || dq+ds == 0 {
+						t.Errorf("query %d song %d %+v: bad step %v -> %v", i, j, c, path[k-1], step)
+					}
+				}
+				if d := sum - sco; d > 0.01 || d < -0.01 {
+					t.Errorf("query %d song %d %+v: path cost %v, score %v", i, j, c, sum, sco)
+				}
+			}
+		}
+	}
+
+	bytes, err := os.ReadFile("testdata/littlebee.txt")
+	if err != nil {
+		t.Fatal("test data not found!")
+	}
+	dat := string(bytes)
+	pitch := ParsePitch(dat[:len(dat)-1])
+	db := InitDatabase()
+	db.AddSong(MakeSong(pitch, "little bee"), "bee")
+	opts := DefaultSearchOptions()
+	opts.Alignment = true
+	res := db.SearchWithOptions(pitch[40:168], opts)
+	if len(res.Songs) != 1 {
+		t.Fatalf("got %d songs, want 1", len(res.Songs))
+	}
+	path := res.Songs[0].Alignment
+	if len(path) < 128 || path[0].Song != res.Songs[0].From || path[len(path)-1].Song != res.Songs[0].To {
+		t.Errorf("alignment of %d steps goes from %v to %v, want song frames %d-%d", len(path), path[0], path[len(path)-1], res.Songs[0].From, res.Songs[0].To)
+	}
+
+	// only the best MaxAlignments results are aligned
+	db.AddSong(MakeSong(pitch, "little bee"), "bee2")
+	opts.MaxAlignments = 1
+	res = db.SearchWithOptions(pitch[40:168], opts)
+	if len(res.Songs) != 2 || res.Songs[0].Alignment == nil || res.Songs[1].Alignment != nil {
+		t.Errorf("MaxAlignments 1 aligns %d songs of %d", countAligned(res.Songs), len(res.Songs))
+	}
+}
+
+func countAligned(songs []SongScore) int {
+	n := 0
+	for _, s := range songs {
+		if s.Alignment != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSnapshot(t *testing.T) {
+	db := InitDatabase()
+	db.AddSong(MakeSong(RandPitch(300), "SongA"), "1")
+	db.AddSong(MakeSong(RandPitch(50), "SongB"), "2")
+	var buf bytes.Buffer
+	if err := db.SaveSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	db2 := InitDatabase()
+	if err := db2.LoadSnapshot(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(db.Songs, db2.Songs) {
+		t.Error("songs differ after loading snapshot")
+	}
+	// notes and relative pitch wait until a search needs them
+	song := db2.Songs["1"]
+	if song.derived.notes != nil || song.derived.relative != nil {
+		t.Error("derived data computed while loading")
+	}
+	view := song.keyInvariant()
+	if !reflect.DeepEqual(view.Pitch, RelativePitch(song.Pitch)) {
+		t.Error("key invariant view has wrong pitch")
+	}
+	if want := SegmentNotes(song.Pitch, DefaultNoteOptions()); !reflect.DeepEqual(view.Notes(), want) ||
+		!reflect.DeepEqual(song.Notes(), want) {
+		t.Error("notes are not of the song pitch")
+	}
+
+	data[len(data)/2] ^= 1
+	db3 := InitDatabase()
+	if err := db3.LoadSnapshot(bytes.NewReader(data)); !errors.Is(err, ErrBadSnapshot) {
+		t.Errorf("corrupt snapshot gives error %v", err)
+	}
+	if len(db3.Songs) != 0 {
+		t.Error("corrupt snapshot should not add songs")
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "journal")
+	snapshot := filepath.Join(dir, "snapshot")
+
+	db := InitDatabase()
+	if _, err := db.AttachJournal(journal); err != nil {
+		t.Fatal(err)
+	}
+	db.AddSong(MakeSong(RandPitch(100), "SongA"), "1")
+	db.AddSong(MakeSong(RandPitch(100), "SongB"), "2")
+	db.AddSong(MakeSong(nil, ""), "1")
+	db.Journal.Close()
+
+	// simulate a crash in the middle of writing a record
+	f, _ := os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{100, 0, 0, 0, 1, 2})
+	f.Close()
+
+	db2 := InitDatabase()
+	count, err := db2.AttachJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || !reflect.DeepEqual(db.Songs, db2.Songs) {
+		t.Errorf("replayed %d records, songs %v", count, db2.Songs)
+	}
+	db2.AddSong(MakeSong(RandPitch(100), "SongC"), "3")
+	if err := db2.Compact(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if db2.Journal.Size() != 0 {
+		t.Error("journal is not empty after compaction")
+	}
+	db2.Journal.Close()
+
+	db3 := InitDatabase()
+	if err := db3.LoadSnapshotFile(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db3.AttachJournal(journal); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(db2.Songs, db3.Songs) {
+		t.Error("songs differ after compaction")
+	}
+	db3.Journal.Close()
+
+	// a broken record before the last one is an error and nothing is cut
+	broken := filepath.Join(dir, "broken")
+	db4 := InitDatabase()
+	if _, err := db4.AttachJournal(broken); err != nil {
+		t.Fatal(err)
+	}
+	db4.AddSong(MakeSong(RandPitch(100), "SongA"), "1")
+	db4.AddSong(MakeSong(RandPitch(100), "SongB"), "2")
+	db4.AddSong(MakeSong(RandPitch(100), "SongC"), "3")
+	db4.Journal.Close()
+	data, _ := os.ReadFile(broken)
+	second := 12 + int(binary.LittleEndian.Uint32(data[:4]))
+	for name, corrupt := range map[string]func([]byte){
+		"checksum": func(d []byte) { d[second+4] ^= 1 },
+		"operation": func(d []byte) {
+			payload := d[second+12 : second+12+int(binary.LittleEndian.Uint32(d[second:]))]
+			payload[0] = 100
+			binary.LittleEndian.PutUint32(d[second+4:], crc32.ChecksumIEEE(payload))
+			binary.LittleEndian.PutUint32(d[second+8:], crc32.ChecksumIEEE(d[second:second+8]))
+		},
+		// must not pass for a record cut short at the end of the file
+		"length": func(d []byte) { binary.LittleEndian.PutUint32(d[second:], uint32(len(d))) },
+	} {
+		bad := append([]byte(nil), data...)
+		corrupt(bad)
+		os.WriteFile(broken, bad, 0644)
+		db5 := InitDatabase()
+		if _, err := db5.AttachJournal(broken); !errors.Is(err, ErrBadJournal) {
+			t.Errorf("%s: expected ErrBadJournal, got %v", name, err)
+		}
+		if after, _ := os.ReadFile(broken); !bytes.Equal(after, bad) {
+			t.Errorf("%s: journal changed after a failed replay", name)
+		}
+	}
+}
+
 func BenchmarkSearch(b *testing.B) {
 	bytes, err := os.ReadFile("testdata/littlebee.txt")
 	if err != nil {
@@ -68,6 +695,104 @@ func BenchmarkSearch(b *testing.B) {
 	}
 }
 
+func BenchmarkSearchPrune(b *testing.B) {
+	bytes, err := os.ReadFile("testdata/littlebee.txt")
+	if err != nil {
+		b.Error("test data not found!")
+	}
+	dat := string(bytes)
+	pitch := ParsePitch(dat[:len(dat)-1])
+	db := InitDatabase()
+	db.AddSong(MakeSong(pitch, "little bee"), "1")
+	for i := 0; i < 20; i++ {
+		db.AddSong(MakeSong(RandPitch(len(pitch)), "random"), strconv.Itoa(i+2))
+	}
+	query := pitch[:128]
+	opts := DefaultSearchOptions()
+	opts.Prune = true
+	for i := 0; i < b.N; i++ {
+		db.SearchWithOptions(query, opts)
+	}
+}
+
+func BenchmarkSearchUnfiltered(b *testing.B) {
+	benchmarkLinearScaling(b, 0)
+}
+
+// compare with BenchmarkSearchUnfiltered, which compares every song with
+// DTW
+func BenchmarkSearchLinearScaling(b *testing.B) {
+	benchmarkLinearScaling(b, 5)
+}
+
+func benchmarkLinearScaling(b *testing.B, candidates int) {
+	bytes, err := os.ReadFile("testdata/littlebee.txt")
+	if err != nil {
+		b.Error("test data not found!")
+	}
+	dat := string(bytes)
+	pitch := ParsePitch(dat[:len(dat)-1])
+	db := InitDatabase()
+	db.AddSong(MakeSong(pitch, "little bee"), "1")
+	rand.Seed(8)
+	for i := 0; i < 20; i++ {
+		db.AddSong(MakeSong(RandPitch(len(pitch)), "random"), strconv.Itoa(i+2))
+	}
+	query := pitch[:128]
+	opts := DefaultSearchOptions()
+	opts.LinearScaling.Candidates = candidates
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.SearchWithOptions(query, opts)
+	}
+}
+
+// compare with BenchmarkSearchTransposed, which shifts the query to each
+// pitch range
+func BenchmarkSearchKeyInvariant(b *testing.B) {
+	benchmarkTransposed(b, true)
+}
+
+func BenchmarkSearchTransposed(b *testing.B) {
+	benchmarkTransposed(b, false)
+}
+
+func benchmarkTransposed(b *testing.B, keyInvariant bool) {
+	bytes, err := os.ReadFile("testdata/littlebee.txt")
+	if err != nil {
+		b.Error("test data not found!")
+	}
+	dat := string(bytes)
+	pitch := ParsePitch(dat[:len(dat)-1])
+	db := InitDatabase()
+	db.AddSong(MakeSong(pitch, "little bee"), "1")
+	rand.Seed(6)
+	for i := 0; i < 20; i++ {
+		db.AddSong(MakeSong(RandPitch(len(pitch)), "random"), strconv.Itoa(i+2))
+	}
+	opts := DefaultSearchOptions()
+	opts.KeyInvariant = keyInvariant
+	opts.NoFilter = true
+	opts.TopK = 1
+	// half a semitone off the song key
+	queries := make([][]PitchType, 8)
+	for k := range queries {
+		queries[k] = make([]PitchType, 128)
+		for i := range queries[k] {
+			queries[k][i] = pitch[k*48+i] + 0.5
+		}
+	}
+	found := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res := db.SearchWithOptions(queries[i%len(queries)], opts)
+		if res.Songs[0].SongId == "1" {
+			found++
+		}
+	}
+	b.ReportMetric(float64(found)/float64(b.N), "top1")
+}
+
 func BenchmarkDTW(b *testing.B) {
 	bytes, err := os.ReadFile("testdata/littlebee.txt")
 	if err != nil {
@@ -95,3 +820,36 @@ func BenchmarkDTWSimd(b *testing.B) {
 		d.DTW_simd(song, query, 0, len(pitch), 0)
 	}
 }
+
+func BenchmarkDTWConstrained(b *testing.B) {
+	benchmarkDTWConstrained(b, false)
+}
+
+// compare with BenchmarkDTWConstrained, which runs the same DTW row by
+// row in Go
+func BenchmarkDTWConstrainedSimd(b *testing.B) {
+	benchmarkDTWConstrained(b, true)
+}
+
+func benchmarkDTWConstrained(b *testing.B, simd bool) {
+	bytes, err := os.ReadFile("testdata/littlebee.txt")
+	if err != nil {
+		b.Error("test data not found!")
+	}
+	dat := string(bytes)
+	pitch := ParsePitch(dat[:len(dat)-1])
+	song := MakeSong(pitch, "")
+	query := pitch[:128]
+	for _, c := range []DTWConstraint{{Band: 10}, {LimitSlope: true}, {Band: 10, LimitSlope: true}} {
+		b.Run(fmt.Sprintf("band%d-slope%v", c.Band, c.LimitSlope), func(b *testing.B) {
+			var d DTW_tmp
+			for i := 0; i < b.N; i++ {
+				if simd {
+					d.DTW_range_constrained(song, query, 0, len(pitch), 0, c)
+				} else {
+					d.dtwConstrained(song.Pitch, query, 0, c)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package qbsh
+
+import (
+	"sort"
+)
+
+type SkylineOptions struct {
+	// notes shorter than this are removed after the reduction, in seconds
+	MinDuration float64
+	// rests shorter than this are filled by extending the previous note,
+	// in seconds. 0 keeps all rests.
+	MaxGap float64
+}
+
+// MidiMelody is the monophonic melody reduced from a MIDI track
+type MidiMelody struct {
+	Track int
+	// channel playing most of the melody
+	Channel int
+	// whether the track had chords or overlapping notes
+	Polyphonic bool
+	Notes      []MidiNote
+}
+
+func DefaultSkylineOptions() SkylineOptions {
+	return SkylineOptions{
+		MinDuration: 0.05,
+		MaxGap:      0.25,
+	}
+}
+
+// Skyline reduces notes to a melody by keeping the highest sounding note
+// at every moment. Percussion is ignored. The result has no overlapping
+// notes and is sorted by start time.
+func Skyline(notes []MidiNote, opts SkylineOptions) []MidiNote {
+	var times []float64
+	var pitched []MidiNote
+	for _, note := range notes {
+		if note.Channel != midiDrumChannel && note.End > note.Start {
+			pitched = append(pitched, note)
+			times = append(times, note.Start, note.End)
+		}
+	}
+	sort.Float64s(times)
+	sort.SliceStable(pitched, func(i, j int) bool {
+		return pitched[i].Start < pitched[j].Start
+	})
+
+	// find the highest note in each interval between note boundaries
+	var pieces []MidiNote
+	var active []MidiNote
+	next := 0
+	for i := 0; i+1 < len(times); i++ {
+		from, to := times[i], times[i+1]
+		if from == to {
+			continue
+		}
+		for next < len(pitched) && pitched[next].Start <= from {
+			active = append(active, pitched[next])
+			next++
+		}
+		alive := active[:0]
+		for _, note := range active {
+			if note.End > from {
+				alive = append(alive, note)
+			}
+		}
+		active = alive
+		top := -1
+		for j, note := range active {
+			// ties go to the later note, like MidiNotesToPitch
+			if top == -1 || note.Key >= active[top].Key {
+				top = j
+			}
+		}
+		if top == -1 {
+			continue
+		}
+		piece := active[top]
+		piece.Start, piece.End = from, to
+		last := len(pieces) - 1
+		// join pieces cut from the same note
+		if last >= 0 && pieces[last].End == from && pieces[last].Key == piece.Key &&
+			pieces[last].Channel == piece.Channel && pieces[last].Velocity == piece.Velocity {
+			pieces[last].End = to
+		} else {
+			pieces = append(pieces, piece)
+		}
+	}
+
+	out := make([]MidiNote, 0, len(pieces))
+	for _, piece := range pieces {
+		if piece.End-piece.Start < opts.MinDuration {
+			continue
+		}
+		if last := len(out) - 1; last >= 0 && piece.Start-out[last].End < opts.MaxGap {
+			out[last].End = piece.Start
+			if out[last].Key == piece.Key {
+				out[last].End = piece.End
+				continue
+			}
+		}
+		out = append(out, piece)
+	}
+	return out
+}
+
+// ExtractMelody reduces a track to a melody with Skyline. A negative track
+// means the melody track is guessed by MelodyTrack.
+func (m *MidiFile) ExtractMelody(track int, opts SkylineOptions) (MidiMelody, error) {
+	if track < 0 {
+		track = m.MelodyTrack()
+		if track < 0 {
+			return MidiMelody{}, ErrNoMelody
+		}
+	}
+	if track >= len(m.Tracks) {
+		return MidiMelody{}, ErrNoMelody
+	}
+	notes := Skyline(m.Tracks[track].Notes, opts)
+	if len(notes) == 0 {
+		return MidiMelody{}, ErrNoMelody
+	}
+	var channelTime [16]float64
+	for _, note := range notes {
+		channelTime[note.Channel] += note.End - note.Start
+	}
+	channel := 0
+	for i := range channelTime {
+		if channelTime[i] > channelTime[channel] {
+			channel = i
+		}
+	}
+	return MidiMelody{
+		Track:      track,
+		Channel:    channel,
+		Polyphonic: m.Tracks[track].polyphony() >= 0.1,
+		Notes:      notes,
+	}, nil
+}
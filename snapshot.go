@@ -0,0 +1,261 @@
+package qbsh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// snapshot file layout, all integers are little endian: magic "QBSHSNAP",
+// version uint32, song count uint32, songs stored by encodeSong, then
+// crc32 (IEEE) of everything before it
+const snapshotMagic = "QBSHSNAP"
+const SnapshotVersion uint32 = 1
+
+var ErrBadSnapshot = errors.New("invalid qbsh snapshot")
+
+// SaveSnapshot writes every song with its precomputed ranges so that
+// LoadSnapshot does not need to call MakeSong again
+func (db *Database) SaveSnapshot(w io.Writer) error {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	return db.saveSnapshotLocked(w)
+}
+
+func (db *Database) saveSnapshotLocked(w io.Writer) error {
+	ids := make([]string, 0, len(db.Songs))
+	for id := range db.Songs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	binary.Write(&buf, binary.LittleEndian, SnapshotVersion)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(ids)))
+	for _, id := range ids {
+		encodeSong(&buf, id, db.Songs[id])
+	}
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// LoadSnapshot adds all songs in a snapshot written by SaveSnapshot.
+// Nothing is added if the snapshot is corrupt or has another version.
+func (db *Database) LoadSnapshot(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	headerSize := len(snapshotMagic) + 8
+	if len(data) < headerSize+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return ErrBadSnapshot
+	}
+	body := data[:len(data)-4]
+	sum := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrBadSnapshot)
+	}
+	version := binary.LittleEndian.Uint32(body[len(snapshotMagic):])
+	if version != SnapshotVersion {
+		return fmt.Errorf("%w: version %d, expected %d", ErrBadSnapshot, version, SnapshotVersion)
+	}
+	count := binary.LittleEndian.Uint32(body[len(snapshotMagic)+4:])
+
+	dec := songDecoder{data: body[headerSize:]}
+	songs := make(map[string]*Song, count)
+	for i := uint32(0); i < count; i++ {
+		id, song := dec.song()
+		if dec.err != nil {
+			return fmt.Errorf("%w: %v", ErrBadSnapshot, dec.err)
+		}
+		songs[id] = song
+	}
+	if len(dec.data) != 0 {
+		return fmt.Errorf("%w: trailing data", ErrBadSnapshot)
+	}
+
+	db.Lock.Lock()
+	for id, song := range songs {
+		db.Songs[id] = song
+	}
+	db.Lock.Unlock()
+	return nil
+}
+
+// LoadSnapshotFile is LoadSnapshot on a file
+func (db *Database) LoadSnapshotFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return db.LoadSnapshot(bufio.NewReader(f))
+}
+
+// SaveSnapshotFile replaces the file at path with a snapshot. It writes a
+// temporary file first so a crash never leaves half a snapshot.
+func (db *Database) SaveSnapshotFile(path string) error {
+	db.Lock.RLock()
+	defer db.Lock.RUnlock()
+	return db.saveSnapshotFileLocked(path)
+}
+
+func (db *Database) saveSnapshotFileLocked(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = db.saveSnapshotLocked(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func encodeSong(buf *bytes.Buffer, id string, song *Song) {
+	writeString(buf, id)
+	writeString(buf, song.Name)
+	writeString(buf, song.Artist)
+	writePitch(buf, song.Pitch)
+	binary.Write(buf, binary.LittleEndian, [3]float32{
+		float32(song.Median), float32(song.Low), float32(song.High),
+	})
+	binary.Write(buf, binary.LittleEndian, uint32(len(song.Ranges)))
+	for _, ran := range song.Ranges {
+		binary.Write(buf, binary.LittleEndian, int64(ran.From))
+		binary.Write(buf, binary.LittleEndian, int64(ran.To))
+		binary.Write(buf, binary.LittleEndian, float32(ran.Median))
+	}
+	writePitch(buf, song.PitchForSimd)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func writePitch(buf *bytes.Buffer, pitch []PitchType) {
+	binary.Write(buf, binary.LittleEndian, uint32(len(pitch)))
+	var tmp [4]byte
+	for _, p := range pitch {
+		binary.LittleEndian.PutUint32(tmp[:], math.Float32bits(float32(p)))
+		buf.Write(tmp[:])
+	}
+}
+
+// songDecoder reads fields written by encodeSong, remembering the first error
+type songDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *songDecoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	out := d.data[:n]
+	d.data = d.data[n:]
+	return out
+}
+
+func (d *songDecoder) uint32() uint32 {
+	b := d.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *songDecoder) int64() int64 {
+	b := d.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (d *songDecoder) float32() PitchType {
+	return PitchType(math.Float32frombits(d.uint32()))
+}
+
+func (d *songDecoder) string() string {
+	n := d.uint32()
+	return string(d.bytes(int(n)))
+}
+
+func (d *songDecoder) pitch() []PitchType {
+	n := int(d.uint32())
+	if d.err != nil || n*4 > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	out := make([]PitchType, n)
+	for i := range out {
+		out[i] = d.float32()
+	}
+	return out
+}
+
+func (d *songDecoder) song() (string, *Song) {
+	id := d.string()
+	song := &Song{}
+	song.Name = d.string()
+	song.Artist = d.string()
+	song.Pitch = d.pitch()
+	song.Median = d.float32()
+	song.Low = d.float32()
+	song.High = d.float32()
+	n := int(d.uint32())
+	if d.err != nil || n*20 > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return id, song
+	}
+	if n > 0 {
+		song.Ranges = make([]SongPitchRange, n)
+	}
+	for i := range song.Ranges {
+		song.Ranges[i].From = int(d.int64())
+		song.Ranges[i].To = int(d.int64())
+		song.Ranges[i].Median = d.float32()
+	}
+	song.PitchForSimd = d.pitch()
+	if d.err != nil {
+		return id, song
+	}
+	song.derived = newSongDerived(song.Pitch)
+	// DTW_simd reads the zero padding after the reversed pitch
+	if len(song.PitchForSimd) != len(song.Pitch)+8 {
+		d.err = errors.New("simd pitch has wrong length")
+	}
+	for _, ran := range song.Ranges {
+		if ran.From < 0 || ran.From > ran.To || ran.To > len(song.Pitch) {
+			d.err = errors.New("pitch range out of bounds")
+		}
+	}
+	return id, song
+}
@@ -0,0 +1,157 @@
+package qbsh
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrBadCursor = errors.New("invalid cursor")
+var ErrBadSortKey = errors.New("sort must be id, name or artist")
+
+// SongInfo is a song as shown to admin tools
+type SongInfo struct {
+	SongId string           `json:"file"`
+	Name   string           `json:"name"`
+	Artist string           `json:"singer"`
+	Length int              `json:"length"`
+	Median PitchType        `json:"median"`
+	Low    PitchType        `json:"low"`
+	High   PitchType        `json:"high"`
+	Ranges []SongPitchRange `json:"ranges,omitempty"`
+	Pitch  []PitchType      `json:"pitch,omitempty"`
+}
+
+type SongListOptions struct {
+	// "id", "name" or "artist", default is id
+	SortBy string
+	// only list songs whose id, name or artist contains Filter, ignoring case
+	Filter string
+	// NextCursor of the previous page, empty for the first page
+	Cursor string
+	// maximum songs in a page, 0 means no limit
+	Limit int
+}
+
+type SongList struct {
+	Songs []SongInfo `json:"songs"`
+	// pass to SongListOptions.Cursor to get the next page, empty at the last page
+	NextCursor string `json:"next,omitempty"`
+	// number of songs matching the filter in all pages
+	Total int `json:"total"`
+}
+
+// GetSong finds a song by id
+func (db *Database) GetSong(id string) (*Song, bool) {
+	db.Lock.RLock()
+	song, ok := db.Songs[id]
+	db.Lock.RUnlock()
+	return song, ok
+}
+
+// MakeSongInfo describes a song with its ranges, and also its pitch if
+// withPitch is true
+func MakeSongInfo(id string, song *Song, withPitch bool) SongInfo {
+	info := SongInfo{
+		SongId: id,
+		Name:   song.Name,
+		Artist: song.Artist,
+		Length: len(song.Pitch),
+		Median: song.Median,
+		Low:    song.Low,
+		High:   song.High,
+		Ranges: song.Ranges,
+	}
+	if withPitch {
+		info.Pitch = song.Pitch
+	}
+	return info
+}
+
+// ListSongs returns one page of songs sorted by opts.SortBy and then id.
+// The cursor remembers the sort order and the last song of a page, so
+// adding or removing songs between requests does not skip or repeat other
+// songs. A cursor made with another SortBy is an ErrBadCursor.
+func (db *Database) ListSongs(opts SongListOptions) (SongList, error) {
+	var sortKey func(id string, song *Song) string
+	sortBy := opts.SortBy
+	switch sortBy {
+	case "", "id":
+		sortBy = "id"
+		sortKey = func(id string, _ *Song) string { return id }
+	case "name":
+		sortKey = func(_ string, song *Song) string { return song.Name }
+	case "artist":
+		sortKey = func(_ string, song *Song) string { return song.Artist }
+	default:
+		return SongList{}, ErrBadSortKey
+	}
+	var afterKey, afterId string
+	if opts.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+		if err != nil {
+			return SongList{}, ErrBadCursor
+		}
+		// a cursor from another sort order points to a wrong place
+		parts := strings.SplitN(string(raw), "\x00", 3)
+		if len(parts) != 3 || parts[0] != sortBy {
+			return SongList{}, ErrBadCursor
+		}
+		afterKey, afterId = parts[1], parts[2]
+	}
+
+	type entry struct {
+		key  string
+		id   string
+		song *Song
+	}
+	filter := strings.ToLower(opts.Filter)
+	db.Lock.RLock()
+	entries := make([]entry, 0, len(db.Songs))
+	for id, song := range db.Songs {
+		if filter != "" &&
+			!strings.Contains(strings.ToLower(id), filter) &&
+			!strings.Contains(strings.ToLower(song.Name), filter) &&
+			!strings.Contains(strings.ToLower(song.Artist), filter) {
+			continue
+		}
+		entries = append(entries, entry{sortKey(id, song), id, song})
+	}
+	db.Lock.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].key != entries[j].key {
+			return entries[i].key < entries[j].key
+		}
+		return entries[i].id < entries[j].id
+	})
+
+	start := 0
+	if opts.Cursor != "" {
+		start = sort.Search(len(entries), func(i int) bool {
+			if entries[i].key != afterKey {
+				return entries[i].key > afterKey
+			}
+			return entries[i].id > afterId
+		})
+	}
+	end := len(entries)
+	if opts.Limit > 0 && start+opts.Limit < end {
+		end = start + opts.Limit
+	}
+
+	list := SongList{
+		Songs: make([]SongInfo, 0, end-start),
+		Total: len(entries),
+	}
+	for _, e := range entries[start:end] {
+		info := MakeSongInfo(e.id, e.song, false)
+		info.Ranges = nil
+		list.Songs = append(list.Songs, info)
+	}
+	if end < len(entries) {
+		last := entries[end-1]
+		list.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(sortBy + "\x00" + last.key + "\x00" + last.id))
+	}
+	return list, nil
+}
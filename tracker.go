@@ -0,0 +1,259 @@
+package qbsh
+
+import "errors"
+
+// PitchOptions configures pYIN pitch tracking, so it can be tuned for
+// voices outside the usual range, or for whistling
+type PitchOptions struct {
+	// lowest and highest pitch found, in Hz
+	Fmin float64
+	Fmax float64
+	// thresholds tried on each frame, and their prior distribution
+	NThresholds    int
+	BetaParameters BetaParameters
+	// semitones between pitch states of the HMM
+	Resolution float64
+	// fastest pitch change in semitones per second
+	MaxTransitionRate float64
+	// frames on the Viterbi path less likely than this are unvoiced
+	VoicedProbability float64
+	// pYIN frames, 100 per second, in each output frame
+	Downsample int
+	// voice activity detection before pYIN, nil to analyze every frame.
+	// It is off by default
+	VAD *VADOptions
+}
+
+// DefaultPitchOptions gives 20 frames per second from 55Hz to 1047Hz
+func DefaultPitchOptions() PitchOptions {
+	return PitchOptions{
+		Fmin:              55,
+		Fmax:              1047,
+		NThresholds:       100,
+		BetaParameters:    BetaParameters{2, 11 + 1.0/3},
+		Resolution:        0.1,
+		MaxTransitionRate: 35.92,
+		VoicedProbability: 0.3,
+		Downsample:        5,
+	}
+}
+
+// FrameRate returns the number of pitch frames per second
+func (opts *PitchOptions) FrameRate() float64 {
+	return 100 / float64(opts.Downsample)
+}
+
+// Validate returns an error if the tracker cannot use opts
+func (opts *PitchOptions) Validate() error {
+	switch {
+	case opts.Fmin <= 0 || opts.Fmax <= opts.Fmin:
+		return errors.New("pitch range must be 0 < Fmin < Fmax")
+	case opts.Fmax >= AnalysisSampleRate/2:
+		return errors.New("Fmax must be below half of AnalysisSampleRate")
+	case opts.NThresholds <= 0:
+		return errors.New("NThresholds must be positive")
+	case opts.BetaParameters.Alpha <= 0 || opts.BetaParameters.Beta <= 0:
+		return errors.New("beta parameters must be positive")
+	case opts.Resolution <= 0:
+		return errors.New("Resolution must be positive")
+	case opts.MaxTransitionRate <= 0:
+		return errors.New("MaxTransitionRate must be positive")
+	case opts.VoicedProbability < 0 || opts.VoicedProbability > 1:
+		return errors.New("VoicedProbability must be from 0 to 1")
+	case opts.Downsample <= 0:
+		return errors.New("Downsample must be positive")
+	}
+	return nil
+}
+
+// PitchTracker is GetWavPitch2 for audio that arrives in chunks, such as
+// a microphone. Write returns pitch frames as soon as they are decided,
+// and Flush decides the rest when the audio ends.
+type PitchTracker struct {
+	// pYIN frames, 100 per second, held back before Write returns them,
+	// because later audio may still change the Viterbi path. 0 holds all
+	// frames until Flush
+	Lag int
+	// voice activity detection before pYIN, nil to analyze every frame
+	VAD *VADOptions
+
+	resampler *Resampler
+	pyin      *Pyin
+	vad       *vad
+	buf       []float64
+	fill      int
+	stepSize  int
+	// from PitchOptions
+	voicedProb float64
+	downsample int
+	// HMM state of frames not decided yet
+	prob     []float64
+	frames   [][]PyinCandidate
+	backpath [][]int
+	voicing  []float64
+	// decided frames waiting to be downsampled
+	pending        []PitchType
+	pendingVoicing []float64
+	// voicing of the frames last returned
+	lastVoicing []float64
+}
+
+// NewPitchTracker creates a tracker for mono audio at sampleRate. The
+// audio is resampled to AnalysisSampleRate as it arrives. sampleRate must
+// be from MinSampleRate to MaxSampleRate.
+func NewPitchTracker(sampleRate int) (*PitchTracker, error) {
+	return NewPitchTrackerWithOptions(sampleRate, DefaultPitchOptions())
+}
+
+// NewPitchTrackerWithOptions is NewPitchTracker with tuned pYIN
+func NewPitchTrackerWithOptions(sampleRate int, opts PitchOptions) (*PitchTracker, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	resampler, err := NewResampler(sampleRate, AnalysisSampleRate)
+	if err != nil {
+		return nil, err
+	}
+	// frames hold at least two periods of the lowest pitch
+	bufSize := 512
+	for bufSize < AnalysisSampleRate/30 || float64(bufSize) < 2*AnalysisSampleRate/opts.Fmin {
+		bufSize *= 2
+	}
+	stepSize := AnalysisSampleRate / 100
+	pyin := PyinCreate(bufSize, AnalysisSampleRate)
+	pyin.HopLength = stepSize
+	pyin.Fmin = opts.Fmin
+	pyin.Fmax = opts.Fmax
+	pyin.NThresholds = opts.NThresholds
+	pyin.BetaParameters = opts.BetaParameters
+	pyin.Resolution = opts.Resolution
+	pyin.MaxTransitionRate = opts.MaxTransitionRate
+	pyin.PyinInit()
+	var vadOpts *VADOptions
+	if opts.VAD != nil {
+		copied := *opts.VAD
+		vadOpts = &copied
+	}
+	return &PitchTracker{
+		Lag:        50,
+		VAD:        vadOpts,
+		vad:        newVAD(bufSize, stepSize, AnalysisSampleRate),
+		resampler:  resampler,
+		pyin:       pyin,
+		buf:        make([]float64, bufSize),
+		stepSize:   stepSize,
+		voicedProb: opts.VoicedProbability,
+		downsample: opts.Downsample,
+		prob:       pyin.PyinHMMInit(),
+	}, nil
+}
+
+// Write analyzes samples from -1 to 1 and returns new pitch frames, 20
+// per second by default, -1 for unvoiced frames
+func (t *PitchTracker) Write(samples []float32) []PitchType {
+	in := make([]float64, len(samples))
+	for i, sample := range samples {
+		in[i] = float64(sample)
+	}
+	return t.write(in)
+}
+
+func (t *PitchTracker) write(samples []float64) []PitchType {
+	for _, sample := range t.resampler.Process(samples) {
+		t.addSample(sample)
+	}
+	return t.decide(false)
+}
+
+func (t *PitchTracker) addSample(sample float64) {
+	t.buf[t.fill] = sample
+	t.fill++
+	if t.fill < len(t.buf) {
+		return
+	}
+	voicing, active := 1.0, true
+	if t.VAD != nil {
+		voicing, active = t.vad.frame(t.buf, t.VAD)
+	}
+	// inactive frames have no candidates, so the HMM sees them unvoiced
+	var cand []PyinCandidate
+	if active {
+		cand = t.pyin.PyinFindFrequency(t.buf)
+	}
+	var back []int
+	t.prob, back = t.pyin.PyinHMMForward(cand, t.prob)
+	t.backpath = append(t.backpath, back)
+	t.frames = append(t.frames, cand)
+	t.voicing = append(t.voicing, voicing)
+	// move buffer
+	copy(t.buf, t.buf[t.stepSize:])
+	t.fill -= t.stepSize
+}
+
+// Flush returns the remaining pitch frames, and resets the tracker for a
+// new recording
+func (t *PitchTracker) Flush() []PitchType {
+	for _, sample := range t.resampler.Flush() {
+		t.addSample(sample)
+	}
+	out := t.decide(true)
+	t.fill = 0
+	t.prob = t.pyin.PyinHMMInit()
+	t.frames = nil
+	t.backpath = nil
+	t.voicing = nil
+	t.pending = nil
+	t.pendingVoicing = nil
+	t.vad.reset()
+	return out
+}
+
+// Voicing returns the confidence from 0 to 1 that each frame returned by
+// the last Write or Flush has voice. A frame without pitch but with high
+// voicing is a dropout rather than a rest.
+func (t *PitchTracker) Voicing() []float64 {
+	return t.lastVoicing
+}
+
+// decide runs Viterbi from the current best state, keeps all but the last
+// Lag frames of the path, and downsamples them
+func (t *PitchTracker) decide(final bool) []PitchType {
+	t.lastVoicing = nil
+	decided := len(t.frames)
+	if !final {
+		if t.Lag <= 0 {
+			return nil
+		}
+		decided -= t.Lag
+	}
+	if decided <= 0 {
+		return nil
+	}
+	better := t.pyin.PyinHMMViterbi(t.frames, t.backpath, t.prob)
+	for i := 0; i < decided; i++ {
+		pitch := ConvertHzToPitch(better[i].Frequency)
+		if better[i].Probability < t.voicedProb {
+			pitch = -1
+		}
+		t.pending = append(t.pending, pitch)
+	}
+	t.pendingVoicing = append(t.pendingVoicing, t.voicing[:decided]...)
+	t.frames = append(t.frames[:0], t.frames[decided:]...)
+	t.backpath = append(t.backpath[:0], t.backpath[decided:]...)
+	t.voicing = append(t.voicing[:0], t.voicing[decided:]...)
+
+	var out []PitchType
+	k := t.downsample
+	n := len(t.pending) / k
+	for i := 0; i < n; i++ {
+		out = append(out, Median(t.pending[i*k:(i+1)*k]))
+		sum := 0.0
+		for _, v := range t.pendingVoicing[i*k : (i+1)*k] {
+			sum += v
+		}
+		t.lastVoicing = append(t.lastVoicing, sum/float64(k))
+	}
+	t.pending = append(t.pending[:0], t.pending[n*k:]...)
+	t.pendingVoicing = append(t.pendingVoicing[:0], t.pendingVoicing[n*k:]...)
+	return out
+}
@@ -0,0 +1,134 @@
+package qbsh
+
+import (
+	"math"
+
+	"github.com/mjibson/go-dsp/fft"
+)
+
+// VADOptions tunes the voice activity detector of PitchTracker. Frames it
+// finds inactive are marked unvoiced without running pYIN.
+type VADOptions struct {
+	// frames quieter than this, in dB below full scale, are silence
+	EnergyFloor float64
+	// dB a frame must be above the estimated noise level
+	MinSNR float64
+	// how fast the noise estimate rises during sound without voice, in dB
+	// per second
+	NoiseRise float64
+	// spectral flatness from 0 (pure tone) to 1 (white noise). Frames
+	// flatter than this are noise
+	MaxFlatness float64
+	// frequency band for flatness in Hz
+	MinFrequency float64
+	MaxFrequency float64
+	// frames kept active after voice stops, for note endings
+	Hangover int
+}
+
+// DefaultVADOptions suits hummed or sung queries
+func DefaultVADOptions() VADOptions {
+	return VADOptions{
+		EnergyFloor:  -55,
+		MinSNR:       10,
+		NoiseRise:    6,
+		MaxFlatness:  0.4,
+		MinFrequency: 55,
+		MaxFrequency: 4000,
+		Hangover:     5,
+	}
+}
+
+// vad keeps the state of voice activity detection between frames
+type vad struct {
+	sampleRate int
+	hopSeconds float64
+	window     []float64
+	spectrum   []complex128
+	// noise level in dB, NaN before the first frame
+	noise float64
+	// frames left before hangover ends
+	hang int
+}
+
+func newVAD(frameLength, hopLength, sampleRate int) *vad {
+	v := &vad{
+		sampleRate: sampleRate,
+		hopSeconds: float64(hopLength) / float64(sampleRate),
+		window:     make([]float64, frameLength),
+		spectrum:   make([]complex128, frameLength),
+	}
+	// Hann window
+	for i := range v.window {
+		v.window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameLength))
+	}
+	v.reset()
+	return v
+}
+
+func (v *vad) reset() {
+	v.noise = math.NaN()
+	v.hang = 0
+}
+
+// logistic maps x to 0..1, 0.5 at 0
+func logistic(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
+
+// frame returns the confidence that buf has voice, and whether pYIN
+// should analyze it
+func (v *vad) frame(buf []float64, opts *VADOptions) (float64, bool) {
+	power := 0.0
+	for _, s := range buf {
+		power += s * s
+	}
+	energy := 10 * math.Log10(power/float64(len(buf))+1e-12)
+
+	// the noise follows quiet frames at once
+	if math.IsNaN(v.noise) {
+		v.noise = math.Min(energy, opts.EnergyFloor)
+	} else if energy < v.noise {
+		v.noise = energy
+	}
+
+	flatness := v.flatness(buf, opts)
+	conf := logistic((energy-opts.EnergyFloor)/2) *
+		logistic((energy-v.noise-opts.MinSNR)/2) *
+		logistic((opts.MaxFlatness-flatness)/0.05)
+	// and rises slowly only in frames without voice, so long notes do
+	// not become noise
+	if conf >= 0.5 {
+		v.hang = opts.Hangover
+		return conf, true
+	}
+	v.noise = math.Min(v.noise+opts.NoiseRise*v.hopSeconds, energy)
+	if v.hang > 0 {
+		v.hang--
+		return conf, true
+	}
+	return conf, false
+}
+
+// flatness is the geometric mean over the arithmetic mean of the power
+// spectrum in the voice band
+func (v *vad) flatness(buf []float64, opts *VADOptions) float64 {
+	for i, s := range buf {
+		v.spectrum[i] = complex(s*v.window[i], 0)
+	}
+	x := fft.FFT(v.spectrum)
+	binHz := float64(v.sampleRate) / float64(len(x))
+	lo := IntMax(int(math.Ceil(opts.MinFrequency/binHz)), 1)
+	hi := IntMin(int(opts.MaxFrequency/binHz), len(x)/2)
+	if lo > hi {
+		return 0
+	}
+	logSum, sum := 0.0, 0.0
+	for i := lo; i <= hi; i++ {
+		p := real(x[i])*real(x[i]) + imag(x[i])*imag(x[i]) + 1e-20
+		logSum += math.Log(p)
+		sum += p
+	}
+	n := float64(hi - lo + 1)
+	return math.Exp(logSum/n) / (sum / n)
+}